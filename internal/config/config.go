@@ -2,16 +2,88 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-const defaultHookTimeoutSeconds = 5
+const (
+	defaultHookTimeoutSeconds       = 5
+	defaultHealthTimeoutSeconds     = 2
+	defaultHealthUnhealthyThreshold = 3
+	defaultHealthHealthyThreshold   = 2
+	defaultBalancer                 = "round-robin"
+	defaultRetryMaxAttempts         = 3
+	defaultRetryInitialBackoffMs    = 100
+	defaultRetryMaxBackoffMs        = 2000
+	defaultRetryBackoffMultiplier   = 2
+	defaultBreakerWindowSize        = 20
+	defaultBreakerMinRequests       = 10
+	defaultBreakerFailureRate       = 50
+	defaultBreakerOpenSeconds       = 30
+	defaultBreakerHalfOpenRequests  = 2
+	defaultConnectTimeoutMs         = 5000
+	defaultTLSHandshakeTimeoutMs    = 5000
+	defaultResponseHeaderTimeoutMs  = 30000
+	defaultTotalTimeoutMs           = 60000
+	defaultDeadlineHeader           = "X-Request-Deadline"
+	defaultMaxQueueWaitMs           = 5000
+	defaultMirrorTimeoutMs          = 10000
+	defaultDiscoveryIntervalSeconds = 10
+	defaultHedgeDelayMs             = 100
+	defaultCacheTTLSeconds          = 60
+	defaultCacheMaxEntries          = 1000
+	defaultCacheMaxBytes            = 50 << 20
+	defaultMaintenanceStatus        = 503
+	defaultMaintenanceString        = "Service unavailable due to maintenance"
+	defaultMaxIdleConns             = 100
+	defaultMaxIdleConnsPerHost      = 2
+	defaultIdleConnTimeoutSeconds   = 90
+	defaultKeepAliveSeconds         = 30
+	defaultAPIKeyHeader             = "X-API-Key"
+	defaultCertReloadSeconds        = 30
+	defaultCertWarningDays          = 14
+)
+
+var (
+	defaultRetryStatus          = []int{502, 503}
+	defaultBreakerFailureStatus = []int{502, 503, 504}
+)
+
+var balancers = map[string]bool{
+	"round-robin":       true,
+	"least-outstanding": true,
+	"weighted":          true,
+}
 
 // Config captures runtime configuration loaded from YAML.
 type Config struct {
-	Hooks []HookConfig `yaml:"hooks"`
+	Hooks     []HookConfig     `yaml:"hooks"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	Routes    []RouteConfig    `yaml:"routes"`
+	Retries   []RetryConfig    `yaml:"retries"`
+	Hedging   []HedgeConfig    `yaml:"hedging"`
+
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+	Timeouts       TimeoutConfig        `yaml:"timeouts"`
+	RateLimits     []RateLimitConfig    `yaml:"rateLimits"`
+	Concurrency    ConcurrencyConfig    `yaml:"concurrency"`
+	Mirror         MirrorConfig         `yaml:"mirror"`
+	HeaderRules    []HeaderRuleConfig   `yaml:"headerRules"`
+	EgressProxy    EgressProxyConfig    `yaml:"egressProxy"`
+	Cache          CacheConfig          `yaml:"cache"`
+	Coalescing     CoalescingConfig     `yaml:"coalescing"`
+	Maintenance    MaintenanceConfig    `yaml:"maintenance"`
+	ConnectionPool ConnectionPoolConfig `yaml:"connectionPool"`
+	ServerTLS      ServerTLSConfig      `yaml:"serverTLS"`
+	CallerIdentity CallerIdentityConfig `yaml:"callerIdentity"`
+	ClientTLS      ClientTLSConfig      `yaml:"clientTLS"`
+	CertExpiry     CertExpiryConfig     `yaml:"certExpiry"`
 }
 
 // HookConfig controls the optional SOAPAction/XPath bridge.
@@ -22,6 +94,367 @@ type HookConfig struct {
 	TimeoutSeconds int    `yaml:"timeoutSeconds"`
 }
 
+// UpstreamConfig names a downstream SOAP endpoint, or a pool of them, that routes can target.
+// URL is shorthand for a pool with a single member.
+type UpstreamConfig struct {
+	Name        string            `yaml:"name"`
+	URL         string            `yaml:"url"`
+	Members     []MemberConfig    `yaml:"members"`
+	Balancer    string            `yaml:"balancer"`
+	HealthCheck HealthCheckConfig `yaml:"healthCheck"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	TLS         UpstreamTLSConfig `yaml:"tls"`
+}
+
+// DiscoveryConfig replaces an upstream's members at runtime with endpoints
+// read from a file (one URL per line, optionally followed by a weight) or
+// resolved from a DNS SRV record. URL or members, if set, are used until the
+// first successful lookup.
+type DiscoveryConfig struct {
+	Type            string `yaml:"type"` // file | srv
+	File            string `yaml:"file"`
+	SRV             string `yaml:"srv"`     // e.g. _soap._tcp.backend.example.com
+	Scheme          string `yaml:"scheme"`  // for SRV members, default https
+	URLPath         string `yaml:"urlPath"` // for SRV members, e.g. /soap
+	IntervalSeconds int    `yaml:"intervalSeconds"`
+}
+
+// UpstreamTLSConfig gives an upstream or a route its own client certificate,
+// CA bundle or server name, and with them its own connection pool. A client
+// certificate set here (PEM files or PKCS12File, with its passphrase)
+// replaces the global one as a whole; CAFile and ServerName fall back to the
+// global CA bundle and the host of the member URL when unset.
+type UpstreamTLSConfig struct {
+	CertFile       string `yaml:"certFile"`
+	KeyFile        string `yaml:"keyFile"`
+	PKCS12File     string `yaml:"pkcs12File"`
+	PassphraseFile string `yaml:"passphraseFile"`
+	PassphraseEnv  string `yaml:"passphraseEnv"`
+	CAFile         string `yaml:"caFile"`
+	ServerName     string `yaml:"serverName"`
+}
+
+// IsZero reports whether no TLS setting is overridden.
+func (t UpstreamTLSConfig) IsZero() bool {
+	return t == UpstreamTLSConfig{}
+}
+
+// MemberConfig is one node of an upstream pool.
+type MemberConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// HealthCheckConfig controls active probes of pool members. Probes run when
+// IntervalSeconds is set; method is GET or SOAP (a POST of body with soapAction).
+type HealthCheckConfig struct {
+	Method             string `yaml:"method"`
+	Path               string `yaml:"path"`
+	SOAPAction         string `yaml:"soapAction"`
+	Body               string `yaml:"body"`
+	ExpectStatus       int    `yaml:"expectStatus"`
+	IntervalSeconds    int    `yaml:"intervalSeconds"`
+	TimeoutSeconds     int    `yaml:"timeoutSeconds"`
+	UnhealthyThreshold int    `yaml:"unhealthyThreshold"`
+	HealthyThreshold   int    `yaml:"healthyThreshold"`
+}
+
+// RouteConfig selects an upstream for requests matching all of the set criteria.
+// A route marked default is used when no other route matches. Fallbacks are
+// tried in order when the upstream cannot be reached. Instead of a single
+// upstream, a route may split traffic between weighted variants.
+type RouteConfig struct {
+	Name         string          `yaml:"name"`
+	SOAPAction   string          `yaml:"soapAction"`
+	PathPrefix   string          `yaml:"pathPrefix"`
+	Header       string          `yaml:"header"`
+	HeaderValue  string          `yaml:"headerValue"`
+	Upstream     string          `yaml:"upstream"`
+	Fallbacks    []string        `yaml:"fallbacks"`
+	Variants     []VariantConfig `yaml:"variants"`
+	StickyHeader string          `yaml:"stickyHeader"`
+	Default      bool            `yaml:"default"`
+
+	// StripPrefix and PathRewrites rewrite the client path before it is
+	// joined with the upstream URL path; UpstreamPath replaces it entirely.
+	StripPrefix  string              `yaml:"stripPrefix"`
+	PathRewrites []PathRewriteConfig `yaml:"pathRewrites"`
+	UpstreamPath string              `yaml:"upstreamPath"`
+
+	// TLS overrides the client certificate and trust settings of the
+	// upstream for requests matching this route. Fallbacks keep their own.
+	TLS UpstreamTLSConfig `yaml:"tls"`
+}
+
+// PathRewriteConfig replaces matches of the regular expression Match in the
+// path with Replace, which may refer to capture groups as $1 or ${name}.
+type PathRewriteConfig struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// VariantConfig is one weighted share of a route's traffic, e.g. a canary.
+type VariantConfig struct {
+	Name     string `yaml:"name"`
+	Upstream string `yaml:"upstream"`
+	Weight   int    `yaml:"weight"`
+}
+
+// RetryConfig is the retry policy for one SOAPAction. Actions without a
+// policy are never retried.
+type RetryConfig struct {
+	SOAPAction              string   `yaml:"soapAction"`
+	MaxAttempts             int      `yaml:"maxAttempts"`
+	InitialBackoffMs        int      `yaml:"initialBackoffMs"`
+	MaxBackoffMs            int      `yaml:"maxBackoffMs"`
+	BackoffMultiplier       float64  `yaml:"backoffMultiplier"`
+	RetryOnStatus           []int    `yaml:"retryOnStatus"`
+	RetryOnFaultCodes       []string `yaml:"retryOnFaultCodes"`
+	RetryOnConnectionErrors bool     `yaml:"retryOnConnectionErrors"`
+}
+
+// HedgeConfig marks a read-only SOAPAction as hedgeable: when no response has
+// arrived after DelayMs, a second copy of the request is sent and the first
+// response wins. With DelayP95, the delay is the action's recent p95 latency
+// instead, and DelayMs applies only until enough samples exist.
+type HedgeConfig struct {
+	SOAPAction string `yaml:"soapAction"`
+	DelayMs    int    `yaml:"delayMs"`
+	DelayP95   bool   `yaml:"delayP95"`
+}
+
+// CircuitBreakerConfig controls the breakers kept per upstream, or per upstream
+// and SOAPAction. A circuit opens when at least failureRatePercent of the last
+// windowSize calls failed, and lets halfOpenRequests trial calls through after
+// openSeconds.
+type CircuitBreakerConfig struct {
+	Enabled            bool  `yaml:"enabled"`
+	PerSOAPAction      bool  `yaml:"perSoapAction"`
+	WindowSize         int   `yaml:"windowSize"`
+	MinRequests        int   `yaml:"minRequests"`
+	FailureRatePercent int   `yaml:"failureRatePercent"`
+	FailureStatus      []int `yaml:"failureStatus"`
+	OpenSeconds        int   `yaml:"openSeconds"`
+	HalfOpenRequests   int   `yaml:"halfOpenRequests"`
+}
+
+// TimeoutConfig bounds each phase of an upstream call. Actions override the
+// connect, TLS handshake, response-header and total timeouts per SOAPAction. When a client
+// sends deadlineHeader (milliseconds remaining, or an RFC 3339 time), the
+// earlier of that deadline and the total timeout applies.
+type TimeoutConfig struct {
+	ConnectMs        int                   `yaml:"connectMs"`
+	TLSHandshakeMs   int                   `yaml:"tlsHandshakeMs"`
+	ResponseHeaderMs int                   `yaml:"responseHeaderMs"`
+	TotalMs          int                   `yaml:"totalMs"`
+	DeadlineHeader   string                `yaml:"deadlineHeader"`
+	Actions          []ActionTimeoutConfig `yaml:"actions"`
+}
+
+// ActionTimeoutConfig overrides timeouts for one SOAPAction; zero values inherit.
+type ActionTimeoutConfig struct {
+	SOAPAction       string `yaml:"soapAction"`
+	ConnectMs        int    `yaml:"connectMs"`
+	TLSHandshakeMs   int    `yaml:"tlsHandshakeMs"`
+	ResponseHeaderMs int    `yaml:"responseHeaderMs"`
+	TotalMs          int    `yaml:"totalMs"`
+}
+
+// RateLimitConfig is a token bucket applied to requests for soapAction (or
+// all actions when empty). ClientKey gives each client its own bucket, keyed
+// by ip, header (the value of Header) or certSubject; perSoapAction splits
+// buckets further by SOAPAction.
+type RateLimitConfig struct {
+	Name          string  `yaml:"name"`
+	SOAPAction    string  `yaml:"soapAction"`
+	ClientKey     string  `yaml:"clientKey"`
+	Header        string  `yaml:"header"`
+	PerSOAPAction bool    `yaml:"perSoapAction"`
+	RatePerSecond float64 `yaml:"ratePerSecond"`
+	Burst         int     `yaml:"burst"`
+}
+
+// ConcurrencyConfig caps requests in flight to the upstreams, globally and per
+// SOAPAction. Excess requests wait in a queue of at most maxQueue for up to
+// maxQueueWaitMs; beyond that they are shed. A zero maxInFlight means unlimited.
+type ConcurrencyConfig struct {
+	BulkheadConfig `yaml:",inline"`
+	Actions        []ActionBulkheadConfig `yaml:"actions"`
+}
+
+// BulkheadConfig is one concurrency cap and its queue. MaxQueue defaults to
+// MaxInFlight; a negative MaxQueue disables queueing.
+type BulkheadConfig struct {
+	MaxInFlight    int `yaml:"maxInFlight"`
+	MaxQueue       int `yaml:"maxQueue"`
+	MaxQueueWaitMs int `yaml:"maxQueueWaitMs"`
+}
+
+// ActionBulkheadConfig is the concurrency cap for one SOAPAction.
+type ActionBulkheadConfig struct {
+	SOAPAction     string `yaml:"soapAction"`
+	BulkheadConfig `yaml:",inline"`
+}
+
+// MirrorConfig replays a percentage of requests (optionally only for the
+// listed SOAPActions) to a shadow upstream, without affecting clients.
+type MirrorConfig struct {
+	Upstream    string   `yaml:"upstream"`
+	Percent     int      `yaml:"percent"`
+	SOAPActions []string `yaml:"soapActions"`
+	TimeoutMs   int      `yaml:"timeoutMs"`
+}
+
+// HeaderRuleConfig rewrites request headers sent upstream and response
+// headers returned to the client, for requests matching When.
+type HeaderRuleConfig struct {
+	When     HeaderMatchConfig `yaml:"when"`
+	Request  []HeaderOpConfig  `yaml:"request"`
+	Response []HeaderOpConfig  `yaml:"response"`
+}
+
+// HeaderMatchConfig restricts a header rule; empty fields match anything.
+type HeaderMatchConfig struct {
+	SOAPAction string `yaml:"soapAction"`
+	PathPrefix string `yaml:"pathPrefix"`
+	Upstream   string `yaml:"upstream"`
+}
+
+// HeaderOpConfig is one header operation: add, set, or remove. Value is a Go
+// text/template, e.g. "{{.TraceID}}" or "{{.Header \"X-Tenant\"}}".
+type HeaderOpConfig struct {
+	Op    string `yaml:"op"`
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// EgressProxyConfig sends upstream connections through an HTTP CONNECT proxy.
+// When URL is empty, the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+// variables are used instead.
+type EgressProxyConfig struct {
+	URL      string   `yaml:"url"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	NoProxy  []string `yaml:"noProxy"`
+}
+
+// CacheConfig caches successful responses of the listed SOAPActions, keyed by
+// SOAPAction and canonicalized request body. MaxEntries and MaxBytes bound the
+// whole cache; least recently used entries are evicted first.
+type CacheConfig struct {
+	MaxEntries int                 `yaml:"maxEntries"`
+	MaxBytes   int                 `yaml:"maxBytes"`
+	Actions    []CacheActionConfig `yaml:"actions"`
+}
+
+// CacheActionConfig enables caching for one SOAPAction. Nodes matching
+// IgnoreXPaths (e.g. message IDs or timestamps) are left out of the cache key.
+type CacheActionConfig struct {
+	SOAPAction   string   `yaml:"soapAction"`
+	TTLSeconds   int      `yaml:"ttlSeconds"`
+	IgnoreXPaths []string `yaml:"ignoreXPaths"`
+}
+
+// CoalescingConfig lists the SOAPActions for which concurrent identical
+// requests share a single upstream call.
+type CoalescingConfig struct {
+	SOAPActions []string `yaml:"soapActions"`
+}
+
+// MaintenanceConfig makes the proxy answer with a SOAP Fault instead of
+// forwarding, for all SOAPActions or only the listed ones. Enabled is the
+// state at startup, which the admin API can change; Windows schedule
+// maintenance in advance.
+type MaintenanceConfig struct {
+	Enabled     bool                `yaml:"enabled"`
+	SOAPActions []string            `yaml:"soapActions"`
+	Fault       MaintenanceFault    `yaml:"fault"`
+	Windows     []MaintenanceWindow `yaml:"windows"`
+}
+
+// MaintenanceFault is the SOAP Fault returned during maintenance. Code is
+// Client or Server (mapped to Sender/Receiver for SOAP 1.2) or a qualified
+// fault code used as is.
+type MaintenanceFault struct {
+	Status            int    `yaml:"status"`
+	Code              string `yaml:"code"`
+	String            string `yaml:"string"`
+	Detail            string `yaml:"detail"`
+	RetryAfterSeconds int    `yaml:"retryAfterSeconds"`
+}
+
+// MaintenanceWindow is a scheduled maintenance period. SOAPActions, if set,
+// overrides the maintenance-wide list for the window.
+type MaintenanceWindow struct {
+	Start       time.Time `yaml:"start"`
+	End         time.Time `yaml:"end"`
+	SOAPActions []string  `yaml:"soapActions"`
+}
+
+// ConnectionPoolConfig tunes the connections kept to the upstreams. Zero
+// values keep the defaults; MaxConnsPerHost 0 means no limit.
+type ConnectionPoolConfig struct {
+	MaxIdleConns           int  `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost    int  `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost        int  `yaml:"maxConnsPerHost"`
+	IdleConnTimeoutSeconds int  `yaml:"idleConnTimeoutSeconds"`
+	KeepAliveSeconds       int  `yaml:"keepAliveSeconds"` // TCP keep-alive probe interval
+	DisableKeepAlives      bool `yaml:"disableKeepAlives"`
+	ForceAttemptHTTP2      bool `yaml:"forceAttemptHTTP2"`
+}
+
+// ServerTLSConfig serves the proxy and UI listeners over TLS.
+type ServerTLSConfig struct {
+	Proxy ListenerTLSConfig `yaml:"proxy"`
+	UI    ListenerTLSConfig `yaml:"ui"`
+}
+
+// ListenerTLSConfig enables TLS on a listener when CertFile and KeyFile are
+// set. With ClientCAFile, clients must present a certificate signed by one
+// of its CAs (mTLS).
+type ListenerTLSConfig struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// CallerIdentityConfig passes the identity of the caller to the upstreams.
+// Each header is only sent when its name is set; copies of the configured
+// headers sent by the client are always removed so they cannot be spoofed.
+// APIKeys name the callers presenting a known key in APIKeyHeader.
+type CallerIdentityConfig struct {
+	SubjectHeader     string         `yaml:"subjectHeader"`
+	SANsHeader        string         `yaml:"sansHeader"`
+	FingerprintHeader string         `yaml:"fingerprintHeader"` // SHA-256 of the client certificate
+	APIKeyNameHeader  string         `yaml:"apiKeyNameHeader"`
+	APIKeyHeader      string         `yaml:"apiKeyHeader"`
+	APIKeys           []APIKeyConfig `yaml:"apiKeys"`
+}
+
+// APIKeyConfig names the caller presenting Key.
+type APIKeyConfig struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+// ClientTLSConfig tunes the client certificate used for mTLS to the
+// upstreams. The certificate, key and CA files are checked for changes every
+// ReloadIntervalSeconds and reloaded without a restart. PKCS12File replaces
+// the PEM certificate and key; its passphrase, or that of an encrypted
+// PKCS#8 key, is read from PassphraseFile or the variable PassphraseEnv.
+type ClientTLSConfig struct {
+	ReloadIntervalSeconds int    `yaml:"reloadIntervalSeconds"`
+	PKCS12File            string `yaml:"pkcs12File"`
+	PassphraseFile        string `yaml:"passphraseFile"`
+	PassphraseEnv         string `yaml:"passphraseEnv"`
+}
+
+// CertExpiryConfig sets how many days before expiry a certificate is
+// flagged.
+type CertExpiryConfig struct {
+	WarningDays int `yaml:"warningDays"`
+}
+
 // Load parses a YAML config file from disk.
 func Load(path string) (*Config, error) {
 	raw, err := os.ReadFile(path)
@@ -39,6 +472,92 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	cfg.Upstreams, err = sanitizeUpstreams(cfg.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Routes, err = sanitizeRoutes(cfg.Upstreams, cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Retries, err = sanitizeRetries(cfg.Retries)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Hedging, err = sanitizeHedging(cfg.Hedging)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.CircuitBreaker, err = sanitizeCircuitBreaker(cfg.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Timeouts, err = sanitizeTimeouts(cfg.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RateLimits, err = sanitizeRateLimits(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Concurrency, err = sanitizeConcurrency(cfg.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Mirror, err = sanitizeMirror(cfg.Upstreams, cfg.Mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.HeaderRules, err = sanitizeHeaderRules(cfg.Upstreams, cfg.HeaderRules)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.EgressProxy, err = sanitizeEgressProxy(cfg.EgressProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Cache, err = sanitizeCache(cfg.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Maintenance, err = sanitizeMaintenance(cfg.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ConnectionPool = sanitizeConnectionPool(cfg.ConnectionPool)
+
+	for name, l := range map[string]ListenerTLSConfig{"proxy": cfg.ServerTLS.Proxy, "ui": cfg.ServerTLS.UI} {
+		if err := sanitizeListenerTLS(l); err != nil {
+			return nil, fmt.Errorf("server TLS config %s: %w", name, err)
+		}
+	}
+
+	cfg.CallerIdentity, err = sanitizeCallerIdentity(cfg.CallerIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ClientTLS, err = sanitizeClientTLS(cfg.ClientTLS)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CertExpiry.WarningDays <= 0 {
+		cfg.CertExpiry.WarningDays = defaultCertWarningDays
+	}
+
 	return &cfg, nil
 }
 
@@ -58,3 +577,615 @@ func sanitizeHooks(in []HookConfig) ([]HookConfig, error) {
 	}
 	return hooks, nil
 }
+
+// ParseUpstreamURL parses the URL of an upstream member, which must be
+// http(s)://host[:port][/path].
+func ParseUpstreamURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("member url must be http(s)://host[:port][/path], got %q", s)
+	}
+	return u, nil
+}
+
+func sanitizeUpstreams(in []UpstreamConfig) ([]UpstreamConfig, error) {
+	var upstreams []UpstreamConfig
+	names := make(map[string]bool, len(in))
+	for _, u := range in {
+		if u.Name == "" {
+			return nil, fmt.Errorf("upstream config: name is required")
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("upstream config: duplicate upstream %q", u.Name)
+		}
+		names[u.Name] = true
+
+		if u.URL != "" {
+			if len(u.Members) > 0 {
+				return nil, fmt.Errorf("upstream %s: set either url or members, not both", u.Name)
+			}
+			u.Members = []MemberConfig{{URL: u.URL}}
+		}
+		d, err := sanitizeDiscovery(u.Discovery)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+		u.Discovery = d
+		if len(u.Members) == 0 && d.Type == "" {
+			return nil, fmt.Errorf("upstream %s: url, members or discovery is required", u.Name)
+		}
+		members := make([]MemberConfig, 0, len(u.Members))
+		for _, m := range u.Members {
+			if m.URL == "" {
+				return nil, fmt.Errorf("upstream %s: member url is required", u.Name)
+			}
+			if _, err := ParseUpstreamURL(m.URL); err != nil {
+				return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+			}
+			if m.Weight <= 0 {
+				m.Weight = 1
+			}
+			members = append(members, m)
+		}
+		u.Members = members
+
+		if u.Balancer == "" {
+			u.Balancer = defaultBalancer
+		}
+		if !balancers[u.Balancer] {
+			return nil, fmt.Errorf("upstream %s: unknown balancer %q", u.Name, u.Balancer)
+		}
+
+		hc, err := sanitizeHealthCheck(u.HealthCheck)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+		u.HealthCheck = hc
+
+		if err := sanitizeUpstreamTLS(u.TLS); err != nil {
+			return nil, fmt.Errorf("upstream %s: tls: %w", u.Name, err)
+		}
+
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+func sanitizeUpstreamTLS(t UpstreamTLSConfig) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if t.CertFile != "" && t.PKCS12File != "" {
+		return fmt.Errorf("set certFile and keyFile or pkcs12File, not both")
+	}
+	if t.PassphraseFile != "" && t.PassphraseEnv != "" {
+		return fmt.Errorf("set passphraseFile or passphraseEnv, not both")
+	}
+	if (t.PassphraseFile != "" || t.PassphraseEnv != "") && t.CertFile == "" && t.PKCS12File == "" {
+		return fmt.Errorf("a passphrase requires certFile and keyFile or pkcs12File")
+	}
+	return nil
+}
+
+func sanitizeDiscovery(d DiscoveryConfig) (DiscoveryConfig, error) {
+	switch d.Type {
+	case "":
+		return DiscoveryConfig{}, nil
+	case "file":
+		if d.File == "" {
+			return d, fmt.Errorf("discovery: file is required")
+		}
+	case "srv":
+		if d.SRV == "" {
+			return d, fmt.Errorf("discovery: srv is required")
+		}
+		if d.Scheme == "" {
+			d.Scheme = "https"
+		}
+	default:
+		return d, fmt.Errorf("discovery: unknown type %q", d.Type)
+	}
+	if d.IntervalSeconds <= 0 {
+		d.IntervalSeconds = defaultDiscoveryIntervalSeconds
+	}
+	return d, nil
+}
+
+func sanitizeHealthCheck(hc HealthCheckConfig) (HealthCheckConfig, error) {
+	if hc.IntervalSeconds <= 0 {
+		return HealthCheckConfig{}, nil
+	}
+	switch hc.Method {
+	case "":
+		hc.Method = "GET"
+	case "GET":
+	case "SOAP":
+		if hc.Body == "" {
+			return hc, fmt.Errorf("health check: body is required for SOAP probes")
+		}
+	default:
+		return hc, fmt.Errorf("health check: method must be GET or SOAP")
+	}
+	if hc.TimeoutSeconds <= 0 {
+		hc.TimeoutSeconds = defaultHealthTimeoutSeconds
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = defaultHealthUnhealthyThreshold
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = defaultHealthHealthyThreshold
+	}
+	return hc, nil
+}
+
+func sanitizeRoutes(upstreams []UpstreamConfig, in []RouteConfig) ([]RouteConfig, error) {
+	names := make(map[string]bool, len(upstreams))
+	for _, u := range upstreams {
+		names[u.Name] = true
+	}
+
+	var routes []RouteConfig
+	seenDefault := false
+	for i, r := range in {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		variants, err := sanitizeVariants(names, r)
+		if err != nil {
+			return nil, err
+		}
+		r.Variants = variants
+		if len(r.Variants) == 0 && !names[r.Upstream] {
+			return nil, fmt.Errorf("route %s: unknown upstream %q", r.Name, r.Upstream)
+		}
+		for _, f := range r.Fallbacks {
+			if !names[f] {
+				return nil, fmt.Errorf("route %s: unknown fallback upstream %q", r.Name, f)
+			}
+		}
+		if r.HeaderValue != "" && r.Header == "" {
+			return nil, fmt.Errorf("route %s: headerValue requires header", r.Name)
+		}
+		for _, pr := range r.PathRewrites {
+			if _, err := regexp.Compile(pr.Match); err != nil {
+				return nil, fmt.Errorf("route %s: path rewrite %q: %w", r.Name, pr.Match, err)
+			}
+		}
+		if err := sanitizeUpstreamTLS(r.TLS); err != nil {
+			return nil, fmt.Errorf("route %s: tls: %w", r.Name, err)
+		}
+		if !r.TLS.IsZero() && len(r.Variants) > 0 {
+			return nil, fmt.Errorf("route %s: tls cannot be combined with variants, set it on the variants' upstreams", r.Name)
+		}
+		if r.UpstreamPath != "" && !strings.HasPrefix(r.UpstreamPath, "/") {
+			r.UpstreamPath = "/" + r.UpstreamPath
+		}
+		if r.Default {
+			if seenDefault {
+				return nil, fmt.Errorf("route %s: only one default route is allowed", r.Name)
+			}
+			seenDefault = true
+		} else if r.SOAPAction == "" && r.PathPrefix == "" && r.Header == "" {
+			return nil, fmt.Errorf("route %s: soapAction, pathPrefix or header is required", r.Name)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func sanitizeVariants(upstreams map[string]bool, r RouteConfig) ([]VariantConfig, error) {
+	if len(r.Variants) == 0 {
+		return nil, nil
+	}
+	if r.Upstream != "" {
+		return nil, fmt.Errorf("route %s: set either upstream or variants, not both", r.Name)
+	}
+
+	var variants []VariantConfig
+	seen := make(map[string]bool, len(r.Variants))
+	total := 0
+	for _, v := range r.Variants {
+		if v.Name == "" {
+			v.Name = v.Upstream
+		}
+		if seen[v.Name] {
+			return nil, fmt.Errorf("route %s: duplicate variant %q", r.Name, v.Name)
+		}
+		seen[v.Name] = true
+		if !upstreams[v.Upstream] {
+			return nil, fmt.Errorf("route %s: variant %s has unknown upstream %q", r.Name, v.Name, v.Upstream)
+		}
+		if v.Weight < 0 {
+			return nil, fmt.Errorf("route %s: variant %s has a negative weight", r.Name, v.Name)
+		}
+		total += v.Weight
+		variants = append(variants, v)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("route %s: variant weights must add up to more than zero", r.Name)
+	}
+	return variants, nil
+}
+
+func sanitizeRetries(in []RetryConfig) ([]RetryConfig, error) {
+	var retries []RetryConfig
+	seen := make(map[string]bool, len(in))
+	for _, r := range in {
+		if r.SOAPAction == "" {
+			return nil, fmt.Errorf("retry config: soapAction is required")
+		}
+		if seen[r.SOAPAction] {
+			return nil, fmt.Errorf("retry config: duplicate policy for %q", r.SOAPAction)
+		}
+		seen[r.SOAPAction] = true
+
+		if r.MaxAttempts <= 0 {
+			r.MaxAttempts = defaultRetryMaxAttempts
+		}
+		if r.InitialBackoffMs <= 0 {
+			r.InitialBackoffMs = defaultRetryInitialBackoffMs
+		}
+		if r.MaxBackoffMs <= 0 {
+			r.MaxBackoffMs = defaultRetryMaxBackoffMs
+		}
+		if r.BackoffMultiplier < 1 {
+			r.BackoffMultiplier = defaultRetryBackoffMultiplier
+		}
+		if len(r.RetryOnStatus) == 0 {
+			r.RetryOnStatus = defaultRetryStatus
+		}
+		retries = append(retries, r)
+	}
+	return retries, nil
+}
+
+func sanitizeHedging(in []HedgeConfig) ([]HedgeConfig, error) {
+	var hedges []HedgeConfig
+	seen := make(map[string]bool, len(in))
+	for _, h := range in {
+		if h.SOAPAction == "" {
+			return nil, fmt.Errorf("hedging config: soapAction is required")
+		}
+		if seen[h.SOAPAction] {
+			return nil, fmt.Errorf("hedging config: duplicate policy for %q", h.SOAPAction)
+		}
+		seen[h.SOAPAction] = true
+
+		if h.DelayMs <= 0 {
+			if !h.DelayP95 {
+				return nil, fmt.Errorf("hedging config %s: delayMs or delayP95 is required", h.SOAPAction)
+			}
+			h.DelayMs = defaultHedgeDelayMs
+		}
+		hedges = append(hedges, h)
+	}
+	return hedges, nil
+}
+
+func sanitizeCircuitBreaker(cb CircuitBreakerConfig) (CircuitBreakerConfig, error) {
+	if !cb.Enabled {
+		return CircuitBreakerConfig{}, nil
+	}
+	if cb.WindowSize <= 0 {
+		cb.WindowSize = defaultBreakerWindowSize
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = defaultBreakerMinRequests
+	}
+	if cb.MinRequests > cb.WindowSize {
+		return cb, fmt.Errorf("circuit breaker: minRequests cannot exceed windowSize")
+	}
+	if cb.FailureRatePercent <= 0 {
+		cb.FailureRatePercent = defaultBreakerFailureRate
+	}
+	if cb.FailureRatePercent > 100 {
+		return cb, fmt.Errorf("circuit breaker: failureRatePercent must be at most 100")
+	}
+	if len(cb.FailureStatus) == 0 {
+		cb.FailureStatus = defaultBreakerFailureStatus
+	}
+	if cb.OpenSeconds <= 0 {
+		cb.OpenSeconds = defaultBreakerOpenSeconds
+	}
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return cb, nil
+}
+
+func sanitizeTimeouts(t TimeoutConfig) (TimeoutConfig, error) {
+	if t.ConnectMs <= 0 {
+		t.ConnectMs = defaultConnectTimeoutMs
+	}
+	if t.TLSHandshakeMs <= 0 {
+		t.TLSHandshakeMs = defaultTLSHandshakeTimeoutMs
+	}
+	if t.ResponseHeaderMs <= 0 {
+		t.ResponseHeaderMs = defaultResponseHeaderTimeoutMs
+	}
+	if t.TotalMs <= 0 {
+		t.TotalMs = defaultTotalTimeoutMs
+	}
+	if t.DeadlineHeader == "" {
+		t.DeadlineHeader = defaultDeadlineHeader
+	}
+
+	seen := make(map[string]bool, len(t.Actions))
+	actions := make([]ActionTimeoutConfig, 0, len(t.Actions))
+	for _, a := range t.Actions {
+		if a.SOAPAction == "" {
+			return t, fmt.Errorf("timeout config: soapAction is required for action overrides")
+		}
+		if seen[a.SOAPAction] {
+			return t, fmt.Errorf("timeout config: duplicate override for %q", a.SOAPAction)
+		}
+		seen[a.SOAPAction] = true
+		if a.ConnectMs <= 0 {
+			a.ConnectMs = t.ConnectMs
+		}
+		if a.TLSHandshakeMs <= 0 {
+			a.TLSHandshakeMs = t.TLSHandshakeMs
+		}
+		if a.ResponseHeaderMs <= 0 {
+			a.ResponseHeaderMs = t.ResponseHeaderMs
+		}
+		if a.TotalMs <= 0 {
+			a.TotalMs = t.TotalMs
+		}
+		actions = append(actions, a)
+	}
+	t.Actions = actions
+	return t, nil
+}
+
+func sanitizeRateLimits(in []RateLimitConfig) ([]RateLimitConfig, error) {
+	var limits []RateLimitConfig
+	for i, l := range in {
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("limit-%d", i+1)
+		}
+		if l.RatePerSecond <= 0 {
+			return nil, fmt.Errorf("rate limit %s: ratePerSecond must be positive", l.Name)
+		}
+		if l.Burst <= 0 {
+			l.Burst = int(math.Ceil(l.RatePerSecond))
+		}
+		switch l.ClientKey {
+		case "", "ip", "certSubject":
+		case "header":
+			if l.Header == "" {
+				return nil, fmt.Errorf("rate limit %s: header is required when clientKey is header", l.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rate limit %s: clientKey must be ip, header or certSubject", l.Name)
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+func sanitizeConcurrency(c ConcurrencyConfig) (ConcurrencyConfig, error) {
+	c.BulkheadConfig = sanitizeBulkhead(c.BulkheadConfig)
+
+	seen := make(map[string]bool, len(c.Actions))
+	actions := make([]ActionBulkheadConfig, 0, len(c.Actions))
+	for _, a := range c.Actions {
+		if a.SOAPAction == "" {
+			return c, fmt.Errorf("concurrency config: soapAction is required for action limits")
+		}
+		if seen[a.SOAPAction] {
+			return c, fmt.Errorf("concurrency config: duplicate limit for %q", a.SOAPAction)
+		}
+		seen[a.SOAPAction] = true
+		if a.MaxInFlight <= 0 {
+			return c, fmt.Errorf("concurrency config: maxInFlight is required for %q", a.SOAPAction)
+		}
+		a.BulkheadConfig = sanitizeBulkhead(a.BulkheadConfig)
+		actions = append(actions, a)
+	}
+	c.Actions = actions
+	return c, nil
+}
+
+func sanitizeBulkhead(b BulkheadConfig) BulkheadConfig {
+	if b.MaxInFlight <= 0 {
+		return BulkheadConfig{}
+	}
+	switch {
+	case b.MaxQueue == 0:
+		b.MaxQueue = b.MaxInFlight
+	case b.MaxQueue < 0:
+		b.MaxQueue = 0
+	}
+	if b.MaxQueueWaitMs <= 0 {
+		b.MaxQueueWaitMs = defaultMaxQueueWaitMs
+	}
+	return b
+}
+
+func sanitizeMirror(upstreams []UpstreamConfig, m MirrorConfig) (MirrorConfig, error) {
+	if m.Upstream == "" {
+		return MirrorConfig{}, nil
+	}
+	if !hasUpstream(upstreams, m.Upstream) {
+		return m, fmt.Errorf("mirror config: unknown upstream %q", m.Upstream)
+	}
+	if m.Percent <= 0 || m.Percent > 100 {
+		m.Percent = 100
+	}
+	if m.TimeoutMs <= 0 {
+		m.TimeoutMs = defaultMirrorTimeoutMs
+	}
+	return m, nil
+}
+
+func sanitizeHeaderRules(upstreams []UpstreamConfig, in []HeaderRuleConfig) ([]HeaderRuleConfig, error) {
+	var rules []HeaderRuleConfig
+	for i, r := range in {
+		if len(r.Request) == 0 && len(r.Response) == 0 {
+			continue
+		}
+		if r.When.Upstream != "" && !hasUpstream(upstreams, r.When.Upstream) {
+			return nil, fmt.Errorf("header rule config %d: unknown upstream %q", i+1, r.When.Upstream)
+		}
+		for _, ops := range [][]HeaderOpConfig{r.Request, r.Response} {
+			for j := range ops {
+				ops[j].Op = strings.ToLower(strings.TrimSpace(ops[j].Op))
+				switch ops[j].Op {
+				case "add", "set", "remove":
+				default:
+					return nil, fmt.Errorf("header rule config %d: unknown op %q", i+1, ops[j].Op)
+				}
+				if ops[j].Name == "" {
+					return nil, fmt.Errorf("header rule config %d: header name is required", i+1)
+				}
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func sanitizeEgressProxy(e EgressProxyConfig) (EgressProxyConfig, error) {
+	if e.URL == "" {
+		if e.Username != "" || len(e.NoProxy) > 0 {
+			return e, fmt.Errorf("egress proxy config: username and noProxy require url")
+		}
+		return e, nil
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return e, fmt.Errorf("egress proxy config: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return e, fmt.Errorf("egress proxy config: url must be http(s)://host:port, got %q", e.URL)
+	}
+	if e.Password != "" && e.Username == "" {
+		return e, fmt.Errorf("egress proxy config: password requires username")
+	}
+	return e, nil
+}
+
+func sanitizeCache(c CacheConfig) (CacheConfig, error) {
+	if len(c.Actions) == 0 {
+		return CacheConfig{}, nil
+	}
+	seen := make(map[string]bool, len(c.Actions))
+	for i, a := range c.Actions {
+		if a.SOAPAction == "" {
+			return c, fmt.Errorf("cache config: soapAction is required")
+		}
+		if seen[a.SOAPAction] {
+			return c, fmt.Errorf("cache config: duplicate entry for %q", a.SOAPAction)
+		}
+		seen[a.SOAPAction] = true
+		if a.TTLSeconds <= 0 {
+			c.Actions[i].TTLSeconds = defaultCacheTTLSeconds
+		}
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaultCacheMaxEntries
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultCacheMaxBytes
+	}
+	return c, nil
+}
+
+func sanitizeMaintenance(m MaintenanceConfig) (MaintenanceConfig, error) {
+	if m.Fault.Status == 0 {
+		m.Fault.Status = defaultMaintenanceStatus
+	}
+	if m.Fault.Status < 400 || m.Fault.Status > 599 {
+		return m, fmt.Errorf("maintenance config: fault status must be 4xx or 5xx, got %d", m.Fault.Status)
+	}
+	if m.Fault.Code == "" {
+		m.Fault.Code = "Server"
+	}
+	if m.Fault.String == "" {
+		m.Fault.String = defaultMaintenanceString
+	}
+	if m.Fault.RetryAfterSeconds < 0 {
+		m.Fault.RetryAfterSeconds = 0
+	}
+	for i, w := range m.Windows {
+		if w.Start.IsZero() || w.End.IsZero() {
+			return m, fmt.Errorf("maintenance config: window %d needs start and end", i+1)
+		}
+		if !w.End.After(w.Start) {
+			return m, fmt.Errorf("maintenance config: window %d ends before it starts", i+1)
+		}
+	}
+	return m, nil
+}
+
+func sanitizeConnectionPool(p ConnectionPoolConfig) ConnectionPoolConfig {
+	if p.MaxIdleConns <= 0 {
+		p.MaxIdleConns = defaultMaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost <= 0 {
+		p.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if p.MaxConnsPerHost < 0 {
+		p.MaxConnsPerHost = 0
+	}
+	if p.IdleConnTimeoutSeconds <= 0 {
+		p.IdleConnTimeoutSeconds = defaultIdleConnTimeoutSeconds
+	}
+	if p.KeepAliveSeconds <= 0 {
+		p.KeepAliveSeconds = defaultKeepAliveSeconds
+	}
+	return p
+}
+
+func sanitizeListenerTLS(l ListenerTLSConfig) error {
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if l.ClientCAFile != "" && l.CertFile == "" {
+		return fmt.Errorf("clientCAFile requires certFile and keyFile")
+	}
+	return nil
+}
+
+func sanitizeCallerIdentity(c CallerIdentityConfig) (CallerIdentityConfig, error) {
+	if len(c.APIKeys) > 0 && c.APIKeyHeader == "" {
+		c.APIKeyHeader = defaultAPIKeyHeader
+	}
+	if c.APIKeyNameHeader != "" && len(c.APIKeys) == 0 {
+		return c, fmt.Errorf("caller identity config: apiKeyNameHeader requires apiKeys")
+	}
+	keys := make(map[string]bool, len(c.APIKeys))
+	for i, k := range c.APIKeys {
+		if k.Name == "" || k.Key == "" {
+			return c, fmt.Errorf("caller identity config: apiKeys[%d] needs a name and a key", i)
+		}
+		if keys[k.Key] {
+			return c, fmt.Errorf("caller identity config: api key %s duplicates another key", k.Name)
+		}
+		keys[k.Key] = true
+	}
+	return c, nil
+}
+
+func sanitizeClientTLS(c ClientTLSConfig) (ClientTLSConfig, error) {
+	if c.ReloadIntervalSeconds <= 0 {
+		c.ReloadIntervalSeconds = defaultCertReloadSeconds
+	}
+	if c.PassphraseFile != "" && c.PassphraseEnv != "" {
+		return c, fmt.Errorf("client TLS config: set passphraseFile or passphraseEnv, not both")
+	}
+	return c, nil
+}
+
+func hasUpstream(upstreams []UpstreamConfig, name string) bool {
+	for _, u := range upstreams {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
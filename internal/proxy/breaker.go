@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+// Circuit states.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// BreakerSet holds one circuit breaker per upstream, or per upstream and
+// SOAPAction, created on first use. A nil BreakerSet disables breaking.
+type BreakerSet struct {
+	cfg           config.CircuitBreakerConfig
+	failureStatus map[int]bool
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// newBreakerSet returns nil when circuit breaking is disabled.
+func newBreakerSet(cfg config.CircuitBreakerConfig) *BreakerSet {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := &BreakerSet{
+		cfg:           cfg,
+		failureStatus: make(map[int]bool, len(cfg.FailureStatus)),
+		breakers:      make(map[string]*breaker),
+	}
+	for _, code := range cfg.FailureStatus {
+		s.failureStatus[code] = true
+	}
+	return s
+}
+
+func (s *BreakerSet) get(upstream, action string) *breaker {
+	if s == nil {
+		return nil
+	}
+	key := upstream
+	if s.cfg.PerSOAPAction && action != "" {
+		key = upstream + "|" + action
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &breaker{
+			key:      key,
+			upstream: upstream,
+			set:      s,
+			state:    circuitClosed,
+			window:   make([]bool, s.cfg.WindowSize),
+		}
+		if s.cfg.PerSOAPAction {
+			b.action = action
+		}
+		s.breakers[key] = b
+	}
+	return b
+}
+
+// BreakerStatus is the API view of a circuit breaker.
+type BreakerStatus struct {
+	Key        string    `json:"key"`
+	Upstream   string    `json:"upstream"`
+	SOAPAction string    `json:"soapAction,omitempty"`
+	State      string    `json:"state"`
+	Requests   int       `json:"requests"`
+	Failures   int       `json:"failures"`
+	ChangedAt  time.Time `json:"changedAt"`
+}
+
+// Status reports every breaker created so far, sorted by key.
+func (s *BreakerSet) Status() []BreakerStatus {
+	if s == nil {
+		return []BreakerStatus{}
+	}
+	s.mu.Lock()
+	breakers := make([]*breaker, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		breakers = append(breakers, b)
+	}
+	s.mu.Unlock()
+
+	out := make([]BreakerStatus, 0, len(breakers))
+	for _, b := range breakers {
+		b.mu.Lock()
+		out = append(out, BreakerStatus{
+			Key:        b.key,
+			Upstream:   b.upstream,
+			SOAPAction: b.action,
+			State:      b.currentState(time.Now()),
+			Requests:   b.count,
+			Failures:   b.failures,
+			ChangedAt:  b.changedAt,
+		})
+		b.mu.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// breaker is a count-based sliding-window circuit breaker.
+type breaker struct {
+	key      string
+	upstream string
+	action   string
+	set      *BreakerSet
+
+	mu        sync.Mutex
+	state     string
+	changedAt time.Time
+
+	// closed state: ring of recent outcomes, true meaning failure
+	window   []bool
+	next     int
+	count    int
+	failures int
+
+	// half-open state
+	probes    int
+	successes int
+}
+
+// allow reports the state seen by a new call and whether it may proceed.
+func (b *breaker) allow() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.currentState(time.Now())
+	if state != b.state {
+		b.transition(state)
+	}
+	switch b.state {
+	case circuitOpen:
+		return b.state, false
+	case circuitHalfOpen:
+		if b.probes >= b.set.cfg.HalfOpenRequests {
+			return b.state, false
+		}
+		b.probes++
+	}
+	return b.state, true
+}
+
+// failed reports whether an attempt outcome counts as a failure.
+func (b *breaker) failed(res *upstreamResult, err error) bool {
+	return err != nil || b.set.failureStatus[res.resp.StatusCode]
+}
+
+// abandon releases a half-open trial slot taken by allow without recording
+// an outcome.
+func (b *breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// record registers the outcome of an allowed call and returns the resulting
+// state change as "from->to", or "" when the state did not change.
+func (b *breaker) record(failed bool) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from := b.state
+	switch b.state {
+	case circuitClosed:
+		if b.count == len(b.window) && b.window[b.next] {
+			b.failures--
+		}
+		if b.count < len(b.window) {
+			b.count++
+		}
+		b.window[b.next] = failed
+		b.next = (b.next + 1) % len(b.window)
+		if failed {
+			b.failures++
+		}
+		if b.count >= b.set.cfg.MinRequests && b.failures*100 >= b.set.cfg.FailureRatePercent*b.count {
+			b.transition(circuitOpen)
+		}
+	case circuitHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if failed {
+			b.transition(circuitOpen)
+			break
+		}
+		b.successes++
+		if b.successes >= b.set.cfg.HalfOpenRequests {
+			b.transition(circuitClosed)
+		}
+	}
+
+	if b.state == from {
+		return ""
+	}
+	return from + "->" + b.state
+}
+
+// currentState returns the state as of now, moving an expired open circuit to half-open.
+func (b *breaker) currentState(now time.Time) string {
+	if b.state == circuitOpen && now.Sub(b.changedAt) >= time.Duration(b.set.cfg.OpenSeconds)*time.Second {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+func (b *breaker) transition(to string) {
+	if b.state == circuitClosed {
+		log.Printf("circuit %s: %s -> %s (%d of last %d calls failed)", b.key, b.state, to, b.failures, b.count)
+	} else {
+		log.Printf("circuit %s: %s -> %s", b.key, b.state, to)
+	}
+	b.state = to
+	b.changedAt = time.Now()
+	b.probes = 0
+	b.successes = 0
+	if to == circuitClosed {
+		for i := range b.window {
+			b.window[i] = false
+		}
+		b.next, b.count, b.failures = 0, 0, 0
+	}
+}
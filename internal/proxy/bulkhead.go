@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+// Bulkheads caps requests in flight to the upstreams, globally and per SOAPAction.
+type Bulkheads struct {
+	global  *bulkhead
+	actions map[string]*bulkhead
+}
+
+// bulkhead is a concurrency cap with a bounded wait queue.
+type bulkhead struct {
+	name     string
+	slots    chan struct{}
+	maxQueue int64
+	maxWait  time.Duration
+	queued   atomic.Int64
+}
+
+func newBulkhead(name string, c config.BulkheadConfig) *bulkhead {
+	if c.MaxInFlight <= 0 {
+		return nil
+	}
+	return &bulkhead{
+		name:     name,
+		slots:    make(chan struct{}, c.MaxInFlight),
+		maxQueue: int64(c.MaxQueue),
+		maxWait:  time.Duration(c.MaxQueueWaitMs) * time.Millisecond,
+	}
+}
+
+// newBulkheads builds Bulkheads from config, or returns nil when no caps are set.
+func newBulkheads(cfg config.ConcurrencyConfig) *Bulkheads {
+	b := &Bulkheads{
+		global:  newBulkhead("global", cfg.BulkheadConfig),
+		actions: make(map[string]*bulkhead, len(cfg.Actions)),
+	}
+	for _, a := range cfg.Actions {
+		b.actions[a.SOAPAction] = newBulkhead(a.SOAPAction, a.BulkheadConfig)
+	}
+	if b.global == nil && len(b.actions) == 0 {
+		return nil
+	}
+	return b
+}
+
+// acquire takes a slot in the SOAPAction's bulkhead and then the global one,
+// waiting in their queues if necessary. It returns the time spent queued and
+// a func releasing the slots.
+func (b *Bulkheads) acquire(ctx context.Context, action string) (time.Duration, func(), error) {
+	if b == nil {
+		return 0, func() {}, nil
+	}
+	start := time.Now()
+	var held []*bulkhead
+	release := func() {
+		for _, h := range held {
+			<-h.slots
+		}
+	}
+	for _, h := range []*bulkhead{b.actions[action], b.global} {
+		if h == nil {
+			continue
+		}
+		if err := h.acquire(ctx); err != nil {
+			release()
+			return time.Since(start), func() {}, err
+		}
+		held = append(held, h)
+	}
+	return time.Since(start), release, nil
+}
+
+// tryAcquire takes a slot in the SOAPAction's bulkhead and the global one
+// only if both are free right away, without queueing. It reports whether it
+// did and returns a func releasing the slots.
+func (b *Bulkheads) tryAcquire(action string) (func(), bool) {
+	if b == nil {
+		return func() {}, true
+	}
+	var held []*bulkhead
+	release := func() {
+		for _, h := range held {
+			<-h.slots
+		}
+	}
+	for _, h := range []*bulkhead{b.actions[action], b.global} {
+		if h == nil {
+			continue
+		}
+		select {
+		case h.slots <- struct{}{}:
+			held = append(held, h)
+		default:
+			release()
+			return func() {}, false
+		}
+	}
+	return release, true
+}
+
+func (h *bulkhead) acquire(ctx context.Context) error {
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if h.queued.Add(1) > h.maxQueue {
+		h.queued.Add(-1)
+		return h.shed(errKindShed, "queue full")
+	}
+	defer h.queued.Add(-1)
+
+	timer := time.NewTimer(h.maxWait)
+	defer timer.Stop()
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return h.shed(errKindQueueTimeout, "timed out waiting in queue")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *bulkhead) shed(kind, reason string) error {
+	return &rejectedError{
+		kind: kind,
+		msg:  fmt.Sprintf("concurrency limit %s: %s", h.name, reason),
+		fault: soapFault{
+			Status: http.StatusServiceUnavailable,
+			Code:   faultCodeServer,
+			Reason: "Upstream capacity exceeded, try again later",
+			Detail: h.name,
+		},
+	}
+}
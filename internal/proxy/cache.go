@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"soap-proxy/internal/config"
+)
+
+// Cache outcomes recorded on traces.
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheStored = "stored"
+)
+
+// ResponseCache serves repeated requests for cacheable SOAPActions from memory.
+type ResponseCache struct {
+	actions    map[string]*cacheAction
+	maxEntries int
+	maxBytes   int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int
+	hits    int64
+	misses  int64
+}
+
+type cacheAction struct {
+	ttl          time.Duration
+	ignoreXPaths []string
+}
+
+type cacheEntry struct {
+	key     string
+	action  string
+	res     *upstreamResult
+	expires time.Time
+}
+
+// CacheStatus is the API view of the response cache.
+type CacheStatus struct {
+	Entries    int                 `json:"entries"`
+	Bytes      int                 `json:"bytes"`
+	MaxEntries int                 `json:"maxEntries"`
+	MaxBytes   int                 `json:"maxBytes"`
+	Hits       int64               `json:"hits"`
+	Misses     int64               `json:"misses"`
+	Actions    []CacheActionStatus `json:"actions"`
+}
+
+// CacheActionStatus is the API view of one cacheable SOAPAction.
+type CacheActionStatus struct {
+	SOAPAction string `json:"soapAction"`
+	TTLSeconds int    `json:"ttlSeconds"`
+	Entries    int    `json:"entries"`
+}
+
+// newResponseCache builds a ResponseCache from config, or returns nil when no
+// SOAPAction is cacheable.
+func newResponseCache(cfg config.CacheConfig) (*ResponseCache, error) {
+	if len(cfg.Actions) == 0 {
+		return nil, nil
+	}
+	c := &ResponseCache{
+		actions:    make(map[string]*cacheAction, len(cfg.Actions)),
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	probe, _ := xmlquery.Parse(strings.NewReader("<probe/>"))
+	for _, a := range cfg.Actions {
+		for _, xp := range a.IgnoreXPaths {
+			if _, err := xmlquery.QueryAll(probe, xp); err != nil {
+				return nil, fmt.Errorf("cache %s: xpath %q: %w", a.SOAPAction, xp, err)
+			}
+		}
+		c.actions[a.SOAPAction] = &cacheAction{
+			ttl:          time.Duration(a.TTLSeconds) * time.Second,
+			ignoreXPaths: a.IgnoreXPaths,
+		}
+	}
+	return c, nil
+}
+
+// key returns the cache key of a request from caller, or "" when the request
+// is not cacheable: its SOAPAction is not configured or its body is not XML.
+func (c *ResponseCache) key(route, action, caller string, body []byte) string {
+	if c == nil {
+		return ""
+	}
+	a := c.actions[action]
+	if a == nil {
+		return ""
+	}
+	return requestKey(route, action, caller, body, a.ignoreXPaths)
+}
+
+// requestKey identifies a request by route, SOAPAction, caller and
+// canonicalized body, leaving out nodes matching ignoreXPaths. It returns ""
+// when the body is not XML.
+func requestKey(route, action, caller string, body []byte, ignoreXPaths []string) string {
+	if len(ignoreXPaths) > 0 {
+		doc, err := xmlquery.Parse(bytes.NewReader(body))
+		if err != nil {
+			return ""
+		}
+		for _, xp := range ignoreXPaths {
+			nodes, _ := xmlquery.QueryAll(doc, xp)
+			for _, n := range nodes {
+				xmlquery.RemoveFromTree(n)
+			}
+		}
+		body = []byte(doc.OutputXML(false))
+	}
+	lines, err := canonicalXML(body)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	_, _ = io.WriteString(h, route+"\n"+action+"\n"+caller+"\n"+strings.Join(lines, "\n"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a fresh copy of the cached response for key, if any.
+func (c *ResponseCache) get(key string, req *http.Request) *upstreamResult {
+	if key == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el := c.entries[key]
+	if el == nil {
+		c.misses++
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		c.misses++
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+
+	return e.res.clone(req)
+}
+
+// put stores a response under key when it is a complete 200 response that is
+// not a SOAP Fault, and reports whether it was stored.
+func (c *ResponseCache) put(key, action string, res *upstreamResult) bool {
+	if key == "" || res.truncated || res.resp.StatusCode != http.StatusOK || soapFaultCode(res.body) != "" {
+		return false
+	}
+	if len(res.body) > c.maxBytes {
+		return false
+	}
+	e := &cacheEntry{
+		key:     key,
+		action:  action,
+		res:     res.clone(nil),
+		expires: time.Now().Add(c.actions[action].ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.entries[key]; el != nil {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += len(res.body)
+	for c.lru.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	return true
+}
+
+// remove drops an entry. c.mu must be held.
+func (c *ResponseCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.bytes -= len(e.res.body)
+}
+
+// Purge drops the cached responses of one SOAPAction, or all of them when
+// action is empty, and returns how many were dropped.
+func (c *ResponseCache) Purge(action string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if action == "" || el.Value.(*cacheEntry).action == action {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// Status reports the cache's size and hit counts.
+func (c *ResponseCache) Status() CacheStatus {
+	if c == nil {
+		return CacheStatus{Actions: []CacheActionStatus{}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := CacheStatus{
+		Entries:    c.lru.Len(),
+		Bytes:      c.bytes,
+		MaxEntries: c.maxEntries,
+		MaxBytes:   c.maxBytes,
+		Hits:       c.hits,
+		Misses:     c.misses,
+	}
+	counts := make(map[string]int, len(c.actions))
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		counts[el.Value.(*cacheEntry).action]++
+	}
+	for name, a := range c.actions {
+		st.Actions = append(st.Actions, CacheActionStatus{
+			SOAPAction: name,
+			TTLSeconds: int(a.ttl / time.Second),
+			Entries:    counts[name],
+		})
+	}
+	sort.Slice(st.Actions, func(i, j int) bool { return st.Actions[i].SOAPAction < st.Actions[j].SOAPAction })
+	return st
+}
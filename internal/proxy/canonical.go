@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// canonicalXML flattens an XML document into one line per attribute and text
+// node, each prefixed with its element path. Names are qualified by namespace
+// URI rather than prefix, attributes are sorted, and comments, processing
+// instructions and whitespace between elements are dropped, so documents that
+// differ only in serialization produce the same lines. Text content is kept
+// as it is, including leading and trailing whitespace.
+func canonicalXML(body []byte) ([]string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var (
+		lines []string
+		path  []string
+		// leaf is set while the innermost open element has no child
+		// elements; whitespace-only text in it is its value, not layout.
+		leaf  bool
+		space string
+	)
+	text := func(s string) {
+		lines = append(lines, "/"+strings.Join(path, "/")+"/text()="+strconv.Quote(s))
+	}
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			leaf, space = true, ""
+			path = append(path, qualifiedName(t.Name))
+			prefix := "/" + strings.Join(path, "/")
+			lines = append(lines, prefix)
+
+			attrs := make([]string, 0, len(t.Attr))
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+					continue
+				}
+				attrs = append(attrs, prefix+"/@"+qualifiedName(a.Name)+"="+a.Value)
+			}
+			sort.Strings(attrs)
+			lines = append(lines, attrs...)
+		case xml.EndElement:
+			if leaf && space != "" {
+				text(space)
+			}
+			leaf, space = false, ""
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+		case xml.CharData:
+			switch s := string(t); {
+			case strings.TrimSpace(s) != "":
+				text(s)
+			case leaf:
+				space += s
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no XML content")
+	}
+	return lines, nil
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return "{" + n.Space + "}" + n.Local
+}
+
+// xmlDifference compares two bodies after canonicalization and describes the
+// first difference, or returns "" when they are equivalent. Bodies that are
+// not XML are compared byte for byte.
+func xmlDifference(a, b []byte) string {
+	ca, errA := canonicalXML(a)
+	cb, errB := canonicalXML(b)
+	if errA != nil || errB != nil {
+		if bytes.Equal(a, b) {
+			return ""
+		}
+		return "bodies differ (not comparable as XML)"
+	}
+
+	for i := 0; i < len(ca) && i < len(cb); i++ {
+		if ca[i] != cb[i] {
+			return "primary " + ca[i] + " vs shadow " + cb[i]
+		}
+	}
+	switch {
+	case len(ca) > len(cb):
+		return "shadow is missing " + ca[len(cb)]
+	case len(cb) > len(ca):
+		return "shadow has extra " + cb[len(ca)]
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate kinds reported by the CertMonitor.
+const (
+	certKindClient   = "client"
+	certKindCA       = "ca"
+	certKindUpstream = "upstream"
+)
+
+// CertMonitor tracks the expiry of the client certificate chain, the CA
+// bundle and the upstream server certificates seen during TLS handshakes.
+type CertMonitor struct {
+	creds   []*ClientCredentials
+	warning time.Duration
+
+	mu       sync.Mutex
+	upstream map[string]seenChain // by upstream name and host
+}
+
+type seenChain struct {
+	upstream string
+	host     string
+	certs    []*x509.Certificate
+}
+
+// CertExpiry is the API view of one certificate.
+type CertExpiry struct {
+	Kind        string    `json:"kind"`
+	Credentials string    `json:"credentials,omitempty"` // of client and CA certificates
+	Upstream    string    `json:"upstream,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotAfter    time.Time `json:"notAfter"`
+	DaysLeft    float64   `json:"daysLeft"`
+	// Warning is set when the certificate expires within the warning window
+	// or has expired.
+	Warning bool `json:"warning"`
+}
+
+// CertExpiryStatus lists the certificates, soonest expiry first.
+type CertExpiryStatus struct {
+	WarningDays  int          `json:"warningDays"`
+	Certificates []CertExpiry `json:"certificates"`
+}
+
+func newCertMonitor(creds []*ClientCredentials, warningDays int) *CertMonitor {
+	return &CertMonitor{
+		creds:    creds,
+		warning:  time.Duration(warningDays) * 24 * time.Hour,
+		upstream: make(map[string]seenChain),
+	}
+}
+
+// observe records the certificates an upstream presented in a handshake,
+// replacing those seen before for the same host.
+func (m *CertMonitor) observe(upstream, host string, cs tls.ConnectionState) {
+	if m == nil || len(cs.PeerCertificates) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream[upstream+"|"+host] = seenChain{upstream: upstream, host: host, certs: cs.PeerCertificates}
+}
+
+// Status reports the days left on every certificate.
+func (m *CertMonitor) Status() CertExpiryStatus {
+	now := time.Now()
+	st := CertExpiryStatus{
+		WarningDays:  int(m.warning / (24 * time.Hour)),
+		Certificates: []CertExpiry{},
+	}
+	seenCAs := make(map[string]bool)
+	add := func(kind, creds, upstream, host string, certs []*x509.Certificate) {
+		for _, c := range certs {
+			if kind == certKindCA {
+				// CA bundles shared by several credentials are listed once.
+				id := c.Issuer.String() + "|" + c.SerialNumber.String()
+				if seenCAs[id] {
+					continue
+				}
+				seenCAs[id] = true
+			}
+			left := c.NotAfter.Sub(now)
+			st.Certificates = append(st.Certificates, CertExpiry{
+				Kind:        kind,
+				Credentials: creds,
+				Upstream:    upstream,
+				Host:        host,
+				Subject:     c.Subject.String(),
+				Issuer:      c.Issuer.String(),
+				Serial:      c.SerialNumber.Text(16),
+				NotAfter:    c.NotAfter,
+				DaysLeft:    left.Hours() / 24,
+				Warning:     left < m.warning,
+			})
+		}
+	}
+
+	for _, creds := range m.creds {
+		chain, cas := creds.certificates()
+		add(certKindClient, creds.name, "", "", chain)
+		add(certKindCA, creds.name, "", "", cas)
+	}
+	m.mu.Lock()
+	for _, s := range m.upstream {
+		add(certKindUpstream, "", s.upstream, s.host, s.certs)
+	}
+	m.mu.Unlock()
+
+	sort.SliceStable(st.Certificates, func(i, j int) bool {
+		return st.Certificates[i].NotAfter.Before(st.Certificates[j].NotAfter)
+	})
+	return st
+}
+
+// WriteMetrics writes the certificate expiry gauges in the Prometheus text
+// format.
+func (m *CertMonitor) WriteMetrics(w io.Writer) {
+	st := m.Status()
+	fmt.Fprintln(w, "# HELP soap_proxy_certificate_expiry_days Days until the certificate expires; negative once expired.")
+	fmt.Fprintln(w, "# TYPE soap_proxy_certificate_expiry_days gauge")
+	for _, c := range st.Certificates {
+		fmt.Fprintf(w, "soap_proxy_certificate_expiry_days{%s} %g\n", certLabels(c), c.DaysLeft)
+	}
+	fmt.Fprintln(w, "# HELP soap_proxy_certificate_not_after_timestamp_seconds Expiry time of the certificate.")
+	fmt.Fprintln(w, "# TYPE soap_proxy_certificate_not_after_timestamp_seconds gauge")
+	for _, c := range st.Certificates {
+		fmt.Fprintf(w, "soap_proxy_certificate_not_after_timestamp_seconds{%s} %d\n", certLabels(c), c.NotAfter.Unix())
+	}
+	fmt.Fprintln(w, "# HELP soap_proxy_certificate_warning_days Warning window for certificate expiry.")
+	fmt.Fprintln(w, "# TYPE soap_proxy_certificate_warning_days gauge")
+	fmt.Fprintf(w, "soap_proxy_certificate_warning_days %d\n", st.WarningDays)
+}
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func certLabels(c CertExpiry) string {
+	return fmt.Sprintf(`kind="%s",credentials="%s",upstream="%s",host="%s",subject="%s",serial="%s"`,
+		c.Kind, labelEscaper.Replace(c.Credentials), labelEscaper.Replace(c.Upstream), labelEscaper.Replace(c.Host),
+		labelEscaper.Replace(c.Subject), c.Serial)
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+// ClientTLS holds the transports to the upstreams: the default one, and one
+// for each upstream and route with TLS settings of its own.
+type ClientTLS struct {
+	def       *tlsProfile
+	upstreams map[string]*tlsProfile
+	routes    map[routeUpstream]*tlsProfile
+	creds     []*ClientCredentials // distinct, default first
+}
+
+// tlsProfile is a transport and the client credentials it presents.
+type tlsProfile struct {
+	creds     *ClientCredentials
+	transport http.RoundTripper
+}
+
+// routeUpstream is a route and the upstream its TLS settings apply to.
+type routeUpstream struct {
+	route, upstream string
+}
+
+// newClientTLS builds the default transport from defaults, and a transport
+// for each upstream and route with a tls section. Credentials loaded from
+// the same files are shared, so they are read and watched once.
+func newClientTLS(cfg *config.Config, defaults CredentialFiles, opts TransportOptions) (*ClientTLS, error) {
+	c := &ClientTLS{
+		upstreams: make(map[string]*tlsProfile),
+		routes:    make(map[routeUpstream]*tlsProfile),
+	}
+	byFiles := make(map[CredentialFiles]*ClientCredentials)
+	profile := func(name string, files CredentialFiles, serverName string) (*tlsProfile, error) {
+		creds := byFiles[files]
+		if creds == nil {
+			var err error
+			if creds, err = NewClientCredentials(name, files); err != nil {
+				return nil, err
+			}
+			byFiles[files] = creds
+			c.creds = append(c.creds, creds)
+		}
+		o := opts
+		o.ServerName = serverName
+		return &tlsProfile{creds: creds, transport: NewMTLSTransport(creds, o)}, nil
+	}
+
+	var err error
+	if c.def, err = profile("default", defaults, ""); err != nil {
+		return nil, err
+	}
+	for _, u := range cfg.Upstreams {
+		if u.TLS.IsZero() {
+			continue
+		}
+		if c.upstreams[u.Name], err = profile("upstream "+u.Name, overrideFiles(defaults, u.TLS), u.TLS.ServerName); err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+	}
+	for _, r := range cfg.Routes {
+		if r.TLS.IsZero() {
+			continue
+		}
+		// The settings are meant for the route's upstream, not for its
+		// fallbacks, which keep their own.
+		if c.routes[routeUpstream{r.Name, r.Upstream}], err = profile("route "+r.Name, overrideFiles(defaults, r.TLS), r.TLS.ServerName); err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// overrideFiles applies the files of a tls section to the defaults. A client
+// certificate replaces the default one together with its passphrase.
+func overrideFiles(defaults CredentialFiles, t config.UpstreamTLSConfig) CredentialFiles {
+	f := defaults
+	if t.CertFile != "" || t.PKCS12File != "" {
+		f = CredentialFiles{
+			CertFile:       t.CertFile,
+			KeyFile:        t.KeyFile,
+			PKCS12File:     t.PKCS12File,
+			CAFile:         defaults.CAFile,
+			PassphraseFile: t.PassphraseFile,
+			PassphraseEnv:  t.PassphraseEnv,
+		}
+	}
+	if t.CAFile != "" {
+		f.CAFile = t.CAFile
+	}
+	return f
+}
+
+// profile returns the transport for requests of route to upstream: the
+// route's own when upstream is the route's upstream, else the upstream's own,
+// else the default one. Requests not tied to a route, like health checks,
+// pass an empty route.
+func (c *ClientTLS) profile(route, upstream string) *tlsProfile {
+	if p := c.routes[routeUpstream{route, upstream}]; p != nil {
+		return p
+	}
+	if p := c.upstreams[upstream]; p != nil {
+		return p
+	}
+	return c.def
+}
+
+// watch reloads every set of credentials when its files change.
+func (c *ClientTLS) watch(ctx context.Context, interval time.Duration) {
+	for _, creds := range c.creds {
+		creds.watch(ctx, interval)
+	}
+}
+
+// Status reports the state of every set of credentials.
+func (c *ClientTLS) Status() []CredentialsStatus {
+	out := make([]CredentialsStatus, 0, len(c.creds))
+	for _, creds := range c.creds {
+		out = append(out, creds.Status())
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"soap-proxy/internal/config"
+	"soap-proxy/internal/trace"
+)
+
+// Coalescer lets concurrent identical requests for opted-in SOAPActions share
+// one upstream call.
+type Coalescer struct {
+	actions map[string]bool
+
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+// sharedCall is an upstream call made by one request, the leader, on behalf
+// of every identical request that arrives while it is in flight.
+type sharedCall struct {
+	leader    string // trace ID of the leading request
+	followers int    // guarded by Coalescer.mu
+	done      chan struct{}
+
+	res         *upstreamResult
+	err         error
+	upstream    string
+	upstreamURL string
+}
+
+// newCoalescer builds a Coalescer from config, or returns nil when no
+// SOAPAction opts in.
+func newCoalescer(cfg config.CoalescingConfig) *Coalescer {
+	if len(cfg.SOAPActions) == 0 {
+		return nil
+	}
+	c := &Coalescer{
+		actions: make(map[string]bool, len(cfg.SOAPActions)),
+		calls:   make(map[string]*sharedCall),
+	}
+	for _, a := range cfg.SOAPActions {
+		c.actions[a] = true
+	}
+	return c
+}
+
+// key returns the coalescing key of a request from caller, or "" when its
+// SOAPAction has not opted in or its body is not XML.
+func (c *Coalescer) key(route, action, caller string, body []byte) string {
+	if c == nil || !c.actions[action] {
+		return ""
+	}
+	return requestKey(route, action, caller, body, nil)
+}
+
+// do runs fn for the first request with a given key and makes identical
+// requests arriving meanwhile wait for its result. Followers are linked to
+// the leader's trace; if the leader was cancelled, they call fn themselves.
+func (c *Coalescer) do(req *http.Request, key string, entry *trace.Entry, fn func() (*upstreamResult, error)) (*upstreamResult, error) {
+	c.mu.Lock()
+	if call := c.calls[key]; call != nil {
+		call.followers++
+		c.mu.Unlock()
+
+		entry.CoalescedWith = call.leader
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if errors.Is(call.err, context.Canceled) {
+			entry.CoalescedWith = ""
+			return fn()
+		}
+		entry.Upstream = call.upstream
+		entry.UpstreamURL = call.upstreamURL
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.res.clone(req), nil
+	}
+	call := &sharedCall{leader: entry.ID, done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	res, err := fn()
+
+	call.err = err
+	if err == nil {
+		call.res = res.clone(nil)
+	}
+	call.upstream = entry.Upstream
+	call.upstreamURL = entry.UpstreamURL
+	c.mu.Lock()
+	delete(c.calls, key)
+	entry.CoalescedRequests = call.followers
+	c.mu.Unlock()
+	close(call.done)
+	return res, err
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientCredentials holds the client certificate and CA bundle used for mTLS
+// to the upstreams, and reloads them when their files change on disk.
+type ClientCredentials struct {
+	name  string
+	files CredentialFiles
+
+	cert  atomic.Pointer[tls.Certificate]
+	roots atomic.Pointer[x509.CertPool]
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	caBytes  []byte
+	chain    []*x509.Certificate // client certificate first
+	cas      []*x509.Certificate
+	status   CredentialsStatus
+}
+
+// CredentialsStatus is the API view of the client credentials.
+type CredentialsStatus struct {
+	Name       string    `json:"name"`
+	CertFile   string    `json:"certFile,omitempty"`
+	KeyFile    string    `json:"keyFile,omitempty"`
+	PKCS12File string    `json:"pkcs12File,omitempty"`
+	CAFile     string    `json:"caFile"`
+	LoadedAt   time.Time `json:"loadedAt"`
+	LastCheck  time.Time `json:"lastCheck"`
+	Reloads    int       `json:"reloads"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// NewClientCredentials loads the client certificate, key and CA bundle.
+// The name tells them apart in logs and the API.
+func NewClientCredentials(name string, files CredentialFiles) (*ClientCredentials, error) {
+	c := &ClientCredentials{
+		name:   name,
+		files:  files,
+		status: CredentialsStatus{Name: name, CAFile: files.CAFile},
+	}
+	if files.PKCS12File != "" {
+		c.status.PKCS12File = files.PKCS12File
+	} else {
+		c.status.CertFile, c.status.KeyFile = files.CertFile, files.KeyFile
+	}
+	modTimes, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTimes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// clientCertificate is the tls.Config.GetClientCertificate hook, so new
+// connections present the certificate loaded last.
+func (c *ClientCredentials) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// rootCAs returns the CA pool loaded last. It is replaced, never modified,
+// when the CA bundle changes.
+func (c *ClientCredentials) rootCAs() *x509.CertPool {
+	return c.roots.Load()
+}
+
+// watch checks the files for changes on every interval until ctx is done.
+func (c *ClientCredentials) watch(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.reload()
+			}
+		}
+	}()
+}
+
+// reload loads the files again when any of them changed. On failure, for
+// instance while the certificate and key are being replaced one after the
+// other, the current credentials are kept and the next check tries again.
+func (c *ClientCredentials) reload() {
+	modTimes, err := c.stat()
+
+	c.mu.Lock()
+	c.status.LastCheck = time.Now()
+	unchanged := err == nil && slices.Equal(modTimes, c.modTimes)
+	c.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	if err == nil {
+		err = c.load(modTimes)
+	}
+	if err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.status.LastError != err.Error() {
+			log.Printf("Client credentials %s: reload failed, keeping the current ones: %v", c.name, err)
+		}
+		c.status.LastError = err.Error()
+		return
+	}
+	log.Printf("Client credentials %s: reloaded from %s", c.name, c.files.source())
+}
+
+func (c *ClientCredentials) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, f := range c.files.paths() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the files and swaps in the new certificate, and the new CA pool
+// when the bundle changed.
+func (c *ClientCredentials) load(modTimes []time.Time) error {
+	cert, err := c.files.keyPair()
+	if err != nil {
+		return err
+	}
+	chain, err := parseChain(cert.Certificate)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.files.source(), err)
+	}
+	caBytes, err := os.ReadFile(c.files.CAFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !bytes.Equal(caBytes, c.caBytes) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in %s", c.files.CAFile)
+		}
+		c.roots.Store(pool)
+		c.caBytes = caBytes
+		c.cas = parsePEMCertificates(caBytes)
+	}
+	c.cert.Store(&cert)
+	c.chain = chain
+
+	if !c.status.LoadedAt.IsZero() {
+		c.status.Reloads++
+	}
+	c.modTimes = modTimes
+	c.status.LoadedAt = time.Now()
+	c.status.LastError = ""
+	return nil
+}
+
+// certificates returns the loaded client certificate chain and CA bundle.
+func (c *ClientCredentials) certificates() (chain, cas []*x509.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chain, c.cas
+}
+
+// subject returns the subject of the client certificate presented.
+func (c *ClientCredentials) subject() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.chain[0].Subject.String()
+}
+
+func parseChain(der [][]byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0, len(der))
+	for _, d := range der {
+		cert, err := x509.ParseCertificate(d)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// parsePEMCertificates returns the certificates of a PEM bundle, skipping
+// blocks that do not parse, as x509.CertPool.AppendCertsFromPEM does.
+func parsePEMCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// Status reports when the credentials were loaded and the last reload error.
+func (c *ClientCredentials) Status() CredentialsStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
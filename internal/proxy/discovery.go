@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+const srvLookupTimeout = 5 * time.Second
+
+// DiscoveryStatus is the API view of an upstream's member discovery.
+type DiscoveryStatus struct {
+	Type        string    `json:"type"`
+	Source      string    `json:"source"`
+	LastRefresh time.Time `json:"lastRefresh"`
+	LastChange  time.Time `json:"lastChange"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// startDiscovery refreshes the pool's members on the configured interval
+// until ctx is done. The first refresh happens before it returns. It is a
+// no-op when discovery is not configured.
+func (u *Upstream) startDiscovery(ctx context.Context) {
+	if u.discovery.Type == "" {
+		return
+	}
+	u.refresh(ctx)
+	go func() {
+		ticker := time.NewTicker(time.Duration(u.discovery.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				u.refresh(ctx)
+			}
+		}
+	}()
+}
+
+// refresh looks up the current endpoints and swaps them into the pool. On
+// failure, or when nothing is found, the current members are kept.
+func (u *Upstream) refresh(ctx context.Context) {
+	found, err := u.discover(ctx)
+	if err == nil && len(found) == 0 {
+		err = errors.New("no endpoints found")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastRefresh = time.Now()
+	if err != nil {
+		if u.discoveryError != err.Error() {
+			log.Printf("upstream %s: discovery from %s failed, keeping %d members: %v", u.Name, u.discoverySource(), len(u.members), err)
+		}
+		u.discoveryError = err.Error()
+		return
+	}
+	u.discoveryError = ""
+
+	if !u.setMembers(found) {
+		return
+	}
+	u.lastChange = u.lastRefresh
+	urls := make([]string, 0, len(u.members))
+	for _, m := range u.members {
+		urls = append(urls, m.URL.String())
+	}
+	log.Printf("upstream %s: discovered members %s", u.Name, strings.Join(urls, ", "))
+}
+
+// setMembers replaces the pool's members, reusing the Member of any endpoint
+// that is unchanged so its health and outstanding count carry over. Requests
+// in flight keep their Member and release it as usual. It reports whether the
+// membership changed. u.mu must be held.
+func (u *Upstream) setMembers(found []config.MemberConfig) bool {
+	existing := make(map[string]*Member, len(u.members))
+	for _, m := range u.members {
+		existing[m.URL.String()] = m
+	}
+
+	members := make([]*Member, 0, len(found))
+	for _, c := range found {
+		old := existing[c.URL]
+		if old != nil && old.Weight == c.Weight {
+			members = append(members, old)
+			continue
+		}
+		m, err := newMember(c.URL, c.Weight)
+		if err != nil {
+			log.Printf("upstream %s: discovered member %q: %v", u.Name, c.URL, err)
+			continue
+		}
+		if old != nil {
+			m.healthy.Store(old.healthy.Load())
+		}
+		members = append(members, m)
+	}
+	if len(members) == 0 {
+		return false
+	}
+	changed := !sameMembers(members, u.members)
+	u.members = members
+	return changed
+}
+
+// sameMembers reports whether a and b have the same member URLs and weights,
+// in any order.
+func sameMembers(a, b []*Member) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int, len(a))
+	for _, m := range a {
+		count[fmt.Sprintf("%s|%d", m.URL, m.Weight)]++
+	}
+	for _, m := range b {
+		key := fmt.Sprintf("%s|%d", m.URL, m.Weight)
+		if count[key] == 0 {
+			return false
+		}
+		count[key]--
+	}
+	return true
+}
+
+func (u *Upstream) discover(ctx context.Context) ([]config.MemberConfig, error) {
+	switch u.discovery.Type {
+	case "file":
+		return readEndpointsFile(u.discovery.File)
+	case "srv":
+		return lookupSRVEndpoints(ctx, u.discovery)
+	}
+	return nil, fmt.Errorf("unknown discovery type %q", u.discovery.Type)
+}
+
+func (u *Upstream) discoverySource() string {
+	if u.discovery.Type == "srv" {
+		return u.discovery.SRV
+	}
+	return u.discovery.File
+}
+
+// readEndpointsFile parses one member URL per line, optionally followed by a
+// weight. Blank lines and lines starting with # are ignored.
+func readEndpointsFile(path string) ([]config.MemberConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var members []config.MemberConfig
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		m := config.MemberConfig{URL: fields[0], Weight: 1}
+		if len(fields) > 1 {
+			w, err := strconv.Atoi(fields[1])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("%s:%d: invalid weight %q", path, line, fields[1])
+			}
+			m.Weight = w
+		}
+		members = append(members, m)
+	}
+	return members, sc.Err()
+}
+
+// lookupSRVEndpoints resolves the SRV record and returns the targets with the
+// lowest priority, weighted by their SRV weight.
+func lookupSRVEndpoints(ctx context.Context, d config.DiscoveryConfig) ([]config.MemberConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, srvLookupTimeout)
+	defer cancel()
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.SRV)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []config.MemberConfig
+	for _, a := range addrs {
+		if a.Priority != addrs[0].Priority {
+			break
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port)))
+		members = append(members, config.MemberConfig{
+			URL:    d.Scheme + "://" + host + d.URLPath,
+			Weight: max(int(a.Weight), 1),
+		})
+	}
+	// LookupSRV shuffles equal-priority records; keep a stable order.
+	sort.Slice(members, func(i, j int) bool { return members[i].URL < members[j].URL })
+	return members, nil
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"soap-proxy/internal/config"
+)
+
+// EgressProxy sends upstream connections through an HTTP CONNECT proxy,
+// except to hosts on the no-proxy list.
+type EgressProxy struct {
+	httpsURL *url.URL
+	httpURL  *url.URL
+	noProxy  []noProxyRule
+	// addrs are the host:port of the proxies, to tell proxy dials apart.
+	addrs map[string]bool
+}
+
+// noProxyRule is one NO_PROXY entry: "*", an IP, a CIDR, or a domain with an
+// optional port. "example.com" matches the domain and its subdomains,
+// ".example.com" only subdomains.
+type noProxyRule struct {
+	all    bool
+	ipNet  *net.IPNet
+	ip     net.IP
+	domain string
+	exact  bool
+	port   string
+}
+
+// newEgressProxy builds an EgressProxy from config, falling back to the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables. It returns nil
+// when no proxy is configured.
+func newEgressProxy(cfg config.EgressProxyConfig) (*EgressProxy, error) {
+	var (
+		httpsStr, httpStr string
+		noProxy           []string
+	)
+	if cfg.URL != "" {
+		httpsStr, httpStr, noProxy = cfg.URL, cfg.URL, cfg.NoProxy
+	} else {
+		httpsStr = getenvAny("HTTPS_PROXY", "https_proxy")
+		httpStr = getenvAny("HTTP_PROXY", "http_proxy")
+		noProxy = strings.Split(getenvAny("NO_PROXY", "no_proxy"), ",")
+	}
+	if httpsStr == "" && httpStr == "" {
+		return nil, nil
+	}
+
+	e := &EgressProxy{addrs: make(map[string]bool)}
+	var err error
+	if e.httpsURL, err = e.parseProxyURL(httpsStr, cfg); err != nil {
+		return nil, err
+	}
+	if e.httpURL, err = e.parseProxyURL(httpStr, cfg); err != nil {
+		return nil, err
+	}
+	for _, s := range noProxy {
+		if s = strings.TrimSpace(s); s != "" {
+			e.noProxy = append(e.noProxy, parseNoProxy(s))
+		}
+	}
+	return e, nil
+}
+
+func (e *EgressProxy) parseProxyURL(s string, cfg config.EgressProxyConfig) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy: %w", err)
+	}
+	if cfg.Username != "" {
+		u.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+	e.addrs[proxyAddr(u)] = true
+	return u, nil
+}
+
+// proxyAddr returns host:port of a proxy URL, as the transport dials it.
+func proxyAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func parseNoProxy(s string) noProxyRule {
+	if s == "*" {
+		return noProxyRule{all: true}
+	}
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return noProxyRule{ipNet: ipNet}
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return noProxyRule{ip: ip}
+	}
+	r := noProxyRule{}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		s, r.port = host, port
+		if ip := net.ParseIP(s); ip != nil {
+			r.ip = ip
+			return r
+		}
+	}
+	s = strings.ToLower(s)
+	if strings.HasPrefix(s, "*.") {
+		s = s[1:]
+	}
+	if !strings.HasPrefix(s, ".") {
+		r.exact = true
+		s = "." + s
+	}
+	r.domain = s
+	return r
+}
+
+func (r noProxyRule) matches(host, port string) bool {
+	if r.all {
+		return true
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case r.ipNet != nil:
+		return ip != nil && r.ipNet.Contains(ip)
+	case r.ip != nil:
+		return ip != nil && r.ip.Equal(ip)
+	}
+	host = "." + strings.ToLower(host)
+	return strings.HasSuffix(host, r.domain) || (r.exact && host == r.domain)
+}
+
+// Proxy picks the proxy for a request, for use as http.Transport.Proxy.
+func (e *EgressProxy) Proxy(req *http.Request) (*url.URL, error) {
+	u := e.httpURL
+	if req.URL.Scheme == "https" {
+		u = e.httpsURL
+	}
+	if u == nil {
+		return nil, nil
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	for _, r := range e.noProxy {
+		if r.matches(req.URL.Hostname(), port) {
+			return nil, nil
+		}
+	}
+	return u, nil
+}
+
+// isProxyAddr reports whether a dial to addr is a dial to the egress proxy.
+func (e *EgressProxy) isProxyAddr(addr string) bool {
+	return e != nil && e.addrs[addr]
+}
+
+// onConnectResponse turns a non-200 CONNECT response into a proxyConnectError.
+func (e *EgressProxy) onConnectResponse(_ context.Context, proxyURL *url.URL, connectReq *http.Request, resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return &proxyConnectError{
+		proxy: proxyURL.Host,
+		err:   fmt.Errorf("CONNECT %s: %s", connectReq.Host, resp.Status),
+	}
+}
+
+// String describes the proxy for logging, without credentials.
+func (e *EgressProxy) String() string {
+	u := e.httpsURL
+	if u == nil {
+		u = e.httpURL
+	}
+	return u.Redacted()
+}
+
+func getenvAny(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
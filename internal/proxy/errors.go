@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// Error classifications recorded on traces.
+const (
+	errKindDial            = "dial"
+	errKindTLS             = "tls"
+	errKindTimeout         = "timeout"
+	errKindConnectTimeout  = "connect_timeout"
+	errKindTLSTimeout      = "tls_handshake_timeout"
+	errKindHeaderTimeout   = "response_header_timeout"
+	errKindDeadline        = "deadline_exceeded"
+	errKindConnectionReset = "connection_reset"
+	errKindCanceled        = "canceled"
+	errKindNoMembers       = "no_members"
+	errKindCircuitOpen     = "circuit_open"
+	errKindRateLimited     = "rate_limited"
+	errKindShed            = "shed"
+	errKindQueueTimeout    = "queue_timeout"
+	errKindProxyConnect    = "proxy_connect"
+	errKindHedgeLost       = "hedge_lost"
+	errKindMaintenance     = "maintenance"
+	errKindTransport       = "transport"
+)
+
+var (
+	errNoMembers   = errors.New("upstream has no members")
+	errCircuitOpen = errors.New("circuit open")
+)
+
+// rejectedError is returned when the proxy refuses a request itself; the
+// client is answered with fault.
+type rejectedError struct {
+	kind  string
+	msg   string
+	fault soapFault
+}
+
+func (e *rejectedError) Error() string { return e.msg }
+
+// proxyConnectError is a failure to reach the upstream through the egress
+// proxy: dialing the proxy, or a CONNECT the proxy refused.
+type proxyConnectError struct {
+	proxy string
+	err   error
+}
+
+func (e *proxyConnectError) Error() string { return "egress proxy " + e.proxy + ": " + e.err.Error() }
+
+func (e *proxyConnectError) Unwrap() error { return e.err }
+
+// classifyError maps an upstream round-trip error to a coarse error kind.
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var rejected *rejectedError
+	if errors.As(err, &rejected) {
+		return rejected.kind
+	}
+	var proxyErr *proxyConnectError
+	if errors.As(err, &proxyErr) {
+		return errKindProxyConnect
+	}
+	if errors.Is(err, errNoMembers) {
+		return errKindNoMembers
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return errKindCircuitOpen
+	}
+	if errors.Is(err, errHedgeLost) {
+		return errKindHedgeLost
+	}
+	if errors.Is(err, errResponseHeaderTimeout) {
+		return errKindHeaderTimeout
+	}
+	if errors.Is(err, errTLSHandshakeTimeout) {
+		return errKindTLSTimeout
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errKindDeadline
+	}
+	if errors.Is(err, context.Canceled) {
+		return errKindCanceled
+	}
+
+	var (
+		recordErr   tls.RecordHeaderError
+		alertErr    tls.AlertError
+		verifyErr   *tls.CertificateVerificationError
+		unknownAuth x509.UnknownAuthorityError
+		invalidCert x509.CertificateInvalidError
+		hostnameErr x509.HostnameError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuth) || errors.As(err, &invalidCert) || errors.As(err, &hostnameErr) {
+		return errKindTLS
+	}
+
+	var opErr *net.OpError
+	isDial := errors.As(err, &opErr) && opErr.Op == "dial"
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		switch {
+		case isDial:
+			return errKindConnectTimeout
+		case strings.Contains(err.Error(), "TLS handshake timeout"):
+			return errKindTLSTimeout
+		}
+		return errKindTimeout
+	}
+
+	if isDial {
+		return errKindDial
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return errKindConnectionReset
+	}
+	return errKindTransport
+}
+
+// isFailoverError reports whether err happened before the request was sent
+// upstream, so it may be sent to a fallback upstream without the risk of
+// executing it twice.
+func isFailoverError(err error) bool {
+	switch classifyError(err) {
+	case errKindDial, errKindConnectTimeout, errKindTLS, errKindTLSTimeout,
+		errKindNoMembers, errKindCircuitOpen, errKindProxyConnect:
+		return true
+	}
+	return false
+}
+
+// isTimeoutKind reports whether an error kind is one of the timeout classifications.
+func isTimeoutKind(kind string) bool {
+	switch kind {
+	case errKindTimeout, errKindConnectTimeout, errKindTLSTimeout, errKindHeaderTimeout, errKindDeadline:
+		return true
+	}
+	return false
+}
+
+// faultFor returns the SOAP Fault sent to the client for err, if the proxy
+// answers such errors itself rather than letting them surface as a 502.
+func faultFor(err error, kind string) (soapFault, bool) {
+	var rejected *rejectedError
+	switch {
+	case errors.As(err, &rejected):
+		return rejected.fault, true
+	case kind == errKindCircuitOpen:
+		return soapFault{
+			Status: http.StatusServiceUnavailable,
+			Code:   faultCodeServer,
+			Reason: "Service temporarily unavailable: circuit open",
+			Detail: err.Error(),
+		}, true
+	case isTimeoutKind(kind):
+		return soapFault{
+			Status: http.StatusGatewayTimeout,
+			Code:   faultCodeServer,
+			Reason: "Upstream timed out (" + kind + ")",
+			Detail: err.Error(),
+		}, true
+	}
+	return soapFault{}, false
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"soap-proxy/internal/trace"
+)
+
+// upstreamResult is an upstream response whose body has been buffered.
+type upstreamResult struct {
+	resp      *http.Response
+	body      []byte
+	truncated bool
+}
+
+// clone returns a copy of r with its own headers and body reader, so the same
+// response can answer another request.
+func (r *upstreamResult) clone(req *http.Request) *upstreamResult {
+	resp := *r.resp
+	resp.Header = r.resp.Header.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(r.body))
+	resp.Request = req
+	return &upstreamResult{resp: &resp, body: r.body, truncated: r.truncated}
+}
+
+// handle applies the admission checks for a request and, once admitted,
+// answers it from the cache, from an identical request in flight, or by
+// dispatching it upstream.
+func (t *LoggingTransport) handle(req *http.Request, body []byte, targets []*Upstream, entry *trace.Entry) (*upstreamResult, error) {
+	if err := t.Maintenance.check(entry.SOAPAction); err != nil {
+		return nil, err
+	}
+	if err := t.Limits.allow(req, entry.SOAPAction); err != nil {
+		return nil, err
+	}
+
+	// Upstreams told who the caller is may answer each caller differently.
+	caller := t.Identity.cacheKey(entry.Caller)
+	var cacheKey string
+	if !entry.Req.Truncated {
+		cacheKey = t.Cache.key(entry.Route, entry.SOAPAction, caller, body)
+	}
+	if res := t.Cache.get(cacheKey, req); res != nil {
+		entry.Cache = cacheHit
+		return res, nil
+	}
+
+	var (
+		res *upstreamResult
+		err error
+	)
+	if key := t.Coalescer.key(entry.Route, entry.SOAPAction, caller, body); key != "" && !entry.Req.Truncated {
+		res, err = t.Coalescer.do(req, key, entry, func() (*upstreamResult, error) {
+			return t.dispatch(req, body, targets, entry)
+		})
+	} else {
+		res, err = t.dispatch(req, body, targets, entry)
+	}
+	if err == nil && cacheKey != "" && entry.CoalescedWith == "" {
+		entry.Cache = cacheMiss
+		if t.Cache.put(cacheKey, entry.SOAPAction, res) {
+			entry.Cache = cacheStored
+		}
+	}
+	return res, err
+}
+
+// dispatch forwards an admitted request within its timeout budget, once the
+// concurrency limits let it through.
+func (t *LoggingTransport) dispatch(req *http.Request, body []byte, targets []*Upstream, entry *trace.Entry) (*upstreamResult, error) {
+	req, cancel, budget := t.Timeouts.apply(req, entry.SOAPAction)
+	defer cancel()
+	entry.TimeoutMs = budget.Milliseconds()
+
+	waited, release, err := t.Bulkheads.acquire(req.Context(), entry.SOAPAction)
+	entry.QueueWaitMs = waited.Milliseconds()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return t.forward(req, body, targets, entry)
+}
+
+// forward sends req to the targets, retrying according to the SOAPAction's
+// retry policy. Requests without a policy get a single try.
+func (t *LoggingTransport) forward(req *http.Request, body []byte, targets []*Upstream, entry *trace.Entry) (*upstreamResult, error) {
+	policy := t.Retries[entry.SOAPAction]
+	for try := 1; ; try++ {
+		res, err := t.tryHedged(req, body, targets, entry, try)
+		if policy == nil || try >= policy.MaxAttempts || !policy.retryable(res, err) {
+			return res, err
+		}
+
+		timer := time.NewTimer(policy.backoff(try))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return res, err
+		case <-timer.C:
+		}
+	}
+}
+
+// tryTargets sends req to the first target. When an attempt fails before the
+// request is sent (dial, TLS or their timeouts), the remaining targets are
+// tried in order.
+func (t *LoggingTransport) tryTargets(req *http.Request, body []byte, targets []*Upstream, entry *trace.Entry, try int) (*upstreamResult, error) {
+	var lastErr error
+	for _, up := range targets {
+		res, err := t.attempt(req, body, up, entry, try)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+		if !isFailoverError(err) || req.Context().Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// attempt sends one copy of req to a member of up and records it on entry.
+func (t *LoggingTransport) attempt(req *http.Request, body []byte, up *Upstream, entry *trace.Entry, try int) (res *upstreamResult, err error) {
+	a := trace.Attempt{
+		Try:       try,
+		Upstream:  up.Name,
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		a.DurationMs = time.Since(a.StartedAt).Milliseconds()
+		if err != nil && errors.Is(context.Cause(req.Context()), errHedgeLost) {
+			err = fmt.Errorf("%w: %w", errHedgeLost, err)
+		}
+		if err != nil {
+			a.Error = err.Error()
+			a.ErrorKind = classifyError(err)
+		} else {
+			a.StatusCode = res.resp.StatusCode
+			a.Proto = res.resp.Proto
+		}
+		entry.Attempts = append(entry.Attempts, a)
+	}()
+
+	if b := t.Breakers.get(up.Name, entry.SOAPAction); b != nil {
+		state, ok := b.allow()
+		a.Circuit = state
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", b.key, errCircuitOpen)
+		}
+		defer func() {
+			// A copy cancelled because the other one won, or a call cut short
+			// by its client, says nothing about the upstream's health.
+			if err != nil && (errors.Is(context.Cause(req.Context()), errHedgeLost) || callerAbandoned(req.Context(), err)) {
+				b.abandon()
+				return
+			}
+			a.CircuitChange = b.record(b.failed(res, err))
+		}()
+	}
+
+	member := up.pick()
+	if member == nil {
+		return nil, fmt.Errorf("%s: %w", up.Name, errNoMembers)
+	}
+	defer member.release()
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	member.rewrite(out)
+
+	t.Timeouts.propagate(out)
+	t.Headers.applyRequest(out.Header, newHeaderData(req, entry, up.Name))
+
+	rt, clientCert := t.upstreamTransport(entry.Route, up.Name)
+	a.ClientCert = clientCert
+
+	out, handshake := startHandshakeTimer(out)
+	defer func() { err = handshake.done(err) }()
+
+	host := out.URL.Host
+	out = out.WithContext(httptrace.WithClientTrace(out.Context(), &httptrace.ClientTrace{
+		GotConn:           func(info httptrace.GotConnInfo) { a.ConnReused = info.Reused },
+		TLSHandshakeStart: handshake.started,
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			handshake.finished()
+			if err == nil {
+				t.Certs.observe(up.Name, host, cs)
+			}
+		},
+	}))
+
+	a.URL = out.URL.String()
+	entry.Upstream = up.Name
+	entry.UpstreamURL = member.URL.String()
+	entry.Path = out.URL.Path
+	entry.Host = out.Host
+	entry.UpstreamReqHeaders = out.Header.Clone()
+
+	return t.send(out, rt)
+}
+
+// upstreamTransport returns the transport for requests of route to upstream
+// and the subject of the client certificate it presents.
+func (t *LoggingTransport) upstreamTransport(route, upstream string) (http.RoundTripper, string) {
+	if t.ClientTLS == nil {
+		return t.Base, ""
+	}
+	p := t.ClientTLS.profile(route, upstream)
+	return p.transport, p.creds.subject()
+}
+
+// send performs a single upstream round trip over rt and buffers the
+// response body.
+func (t *LoggingTransport) send(out *http.Request, rt http.RoundTripper) (res *upstreamResult, err error) {
+	out, timer := startHeaderTimer(out)
+	defer func() { err = timer.done(err) }()
+
+	resp, err := rt.RoundTrip(out)
+	timer.stop()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if resp.Body != nil {
+		_, err = io.Copy(&buf, io.LimitReader(resp.Body, maxBodySize+1))
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	res = &upstreamResult{resp: resp, body: buf.Bytes()}
+	if len(res.body) > maxBodySize {
+		res.body = res.body[:maxBodySize]
+		res.truncated = true
+	}
+	return res, nil
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"soap-proxy/internal/config"
+	"soap-proxy/internal/trace"
+)
+
+// Header rule operations.
+const (
+	headerOpAdd    = "add"
+	headerOpSet    = "set"
+	headerOpRemove = "remove"
+)
+
+// HeaderRules rewrites headers on upstream requests and client responses.
+type HeaderRules struct {
+	rules []*headerRule
+}
+
+type headerRule struct {
+	soapAction string
+	pathPrefix string
+	upstream   string
+	request    []headerOp
+	response   []headerOp
+}
+
+type headerOp struct {
+	op    string
+	name  string
+	value *template.Template
+}
+
+// headerData is what header value templates can refer to, e.g. {{.SOAPAction}}
+// or {{.Header "Trackingid"}}.
+type headerData struct {
+	TraceID    string
+	SOAPAction string
+	Route      string
+	Variant    string
+	Upstream   string
+	ClientAddr string
+	Path       string
+
+	clientHeader http.Header
+}
+
+// Header returns a header of the client request.
+func (d *headerData) Header(name string) string {
+	return d.clientHeader.Get(name)
+}
+
+func newHeaderData(req *http.Request, entry *trace.Entry, upstream string) *headerData {
+	return &headerData{
+		TraceID:      entry.ID,
+		SOAPAction:   entry.SOAPAction,
+		Route:        entry.Route,
+		Variant:      entry.Variant,
+		Upstream:     upstream,
+		ClientAddr:   entry.ClientAddr,
+		Path:         entry.OriginalPath,
+		clientHeader: req.Header,
+	}
+}
+
+// newHeaderRules builds HeaderRules from config, or returns nil when there are none.
+func newHeaderRules(cfgs []config.HeaderRuleConfig) (*HeaderRules, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	h := &HeaderRules{}
+	for i, c := range cfgs {
+		r := &headerRule{
+			soapAction: c.When.SOAPAction,
+			pathPrefix: c.When.PathPrefix,
+			upstream:   c.When.Upstream,
+		}
+		var err error
+		if r.request, err = newHeaderOps(c.Request); err != nil {
+			return nil, fmt.Errorf("header rule %d: %w", i+1, err)
+		}
+		if r.response, err = newHeaderOps(c.Response); err != nil {
+			return nil, fmt.Errorf("header rule %d: %w", i+1, err)
+		}
+		h.rules = append(h.rules, r)
+	}
+	return h, nil
+}
+
+func newHeaderOps(cfgs []config.HeaderOpConfig) ([]headerOp, error) {
+	ops := make([]headerOp, 0, len(cfgs))
+	for _, c := range cfgs {
+		op := headerOp{op: c.Op, name: c.Name}
+		if c.Op != headerOpRemove {
+			tmpl, err := template.New(c.Name).Option("missingkey=zero").Parse(c.Value)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %w", c.Name, err)
+			}
+			op.value = tmpl
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (r *headerRule) matches(d *headerData) bool {
+	return (r.soapAction == "" || r.soapAction == d.SOAPAction) &&
+		(r.pathPrefix == "" || strings.HasPrefix(d.Path, r.pathPrefix)) &&
+		(r.upstream == "" || r.upstream == d.Upstream)
+}
+
+// applyRequest rewrites the headers of a request about to be sent upstream.
+func (h *HeaderRules) applyRequest(header http.Header, d *headerData) {
+	if h == nil {
+		return
+	}
+	for _, r := range h.rules {
+		if r.matches(d) {
+			applyHeaderOps(header, r.request, d)
+		}
+	}
+}
+
+// applyResponse rewrites the headers of a response about to be sent to the
+// client, reporting whether any rule matched.
+func (h *HeaderRules) applyResponse(header http.Header, d *headerData) bool {
+	if h == nil {
+		return false
+	}
+	matched := false
+	for _, r := range h.rules {
+		if r.matches(d) && len(r.response) > 0 {
+			applyHeaderOps(header, r.response, d)
+			matched = true
+		}
+	}
+	return matched
+}
+
+func applyHeaderOps(header http.Header, ops []headerOp, d *headerData) {
+	for _, op := range ops {
+		if op.op == headerOpRemove {
+			header.Del(op.name)
+			continue
+		}
+		var b strings.Builder
+		if err := op.value.Execute(&b, d); err != nil {
+			log.Printf("header rule %s: %v", op.name, err)
+			continue
+		}
+		switch op.op {
+		case headerOpAdd:
+			header.Add(op.name, b.String())
+		case headerOpSet:
+			header.Set(op.name, b.String())
+		}
+	}
+}
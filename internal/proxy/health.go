@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// startHealthChecks probes every member of the pool on the configured interval
+// until ctx is done. It is a no-op when health checks are disabled.
+func (u *Upstream) startHealthChecks(ctx context.Context, rt http.RoundTripper) {
+	if u.health.IntervalSeconds <= 0 {
+		return
+	}
+	client := &http.Client{
+		Transport: rt,
+		Timeout:   time.Duration(u.health.TimeoutSeconds) * time.Second,
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(u.health.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			u.checkAll(ctx, client)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (u *Upstream) checkAll(ctx context.Context, client *http.Client) {
+	u.mu.RLock()
+	members := append([]*Member(nil), u.members...)
+	u.mu.RUnlock()
+
+	for _, m := range members {
+		go u.check(ctx, client, m)
+	}
+}
+
+func (u *Upstream) check(ctx context.Context, client *http.Client, m *Member) {
+	err := u.probe(ctx, client, m)
+
+	m.checkMu.Lock()
+	defer m.checkMu.Unlock()
+	m.lastCheck = time.Now()
+	if err != nil {
+		m.lastError = err.Error()
+		m.successes = 0
+		m.failures++
+		if m.healthy.Load() && m.failures >= u.health.UnhealthyThreshold {
+			m.healthy.Store(false)
+			log.Printf("upstream %s: member %s ejected: %v", u.Name, m.URL, err)
+		}
+		return
+	}
+	m.lastError = ""
+	m.failures = 0
+	m.successes++
+	if !m.healthy.Load() && m.successes >= u.health.HealthyThreshold {
+		m.healthy.Store(true)
+		log.Printf("upstream %s: member %s re-admitted", u.Name, m.URL)
+	}
+}
+
+func (u *Upstream) probe(ctx context.Context, client *http.Client, m *Member) error {
+	target := *m.URL
+	if u.health.Path != "" {
+		target.Path = u.health.Path
+	}
+
+	method := http.MethodGet
+	var body io.Reader
+	if u.health.Method == "SOAP" {
+		method = http.MethodPost
+		body = strings.NewReader(u.health.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return fmt.Errorf("build probe: %w", err)
+	}
+	if u.health.Method == "SOAP" {
+		req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+		req.Header.Set("SOAPAction", `"`+u.health.SOAPAction+`"`)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if u.health.ExpectStatus != 0 {
+		if resp.StatusCode != u.health.ExpectStatus {
+			return fmt.Errorf("probe returned status %d, want %d", resp.StatusCode, u.health.ExpectStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("probe returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"soap-proxy/internal/config"
+	"soap-proxy/internal/trace"
+)
+
+const (
+	// hedgeSamples is how many recent latencies a p95 hedge delay is computed from.
+	hedgeSamples = 100
+	// hedgeMinSamples is how many latencies are needed before the p95 is used.
+	hedgeMinSamples = 20
+)
+
+var errHedgeLost = errors.New("hedged request lost to a faster copy")
+
+// HedgePolicy sends a second copy of a slow request for one SOAPAction.
+type HedgePolicy struct {
+	SOAPAction string
+	delay      time.Duration
+	p95        bool
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// newHedgePolicies builds HedgePolicies from config, keyed by SOAPAction.
+func newHedgePolicies(cfgs []config.HedgeConfig) map[string]*HedgePolicy {
+	policies := make(map[string]*HedgePolicy, len(cfgs))
+	for _, c := range cfgs {
+		policies[c.SOAPAction] = &HedgePolicy{
+			SOAPAction: c.SOAPAction,
+			delay:      time.Duration(c.DelayMs) * time.Millisecond,
+			p95:        c.DelayP95,
+		}
+	}
+	return policies
+}
+
+// hedgeDelay returns how long to wait for a response before sending the copy.
+func (p *HedgePolicy) hedgeDelay() time.Duration {
+	if !p.p95 {
+		return p.delay
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.latencies) < hedgeMinSamples {
+		return p.delay
+	}
+	sorted := append([]time.Duration(nil), p.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*95-1)/100]
+}
+
+// observe records the latency of a successful response.
+func (p *HedgePolicy) observe(d time.Duration) {
+	if !p.p95 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.latencies) < hedgeSamples {
+		p.latencies = append(p.latencies, d)
+		return
+	}
+	p.latencies[p.next] = d
+	p.next = (p.next + 1) % hedgeSamples
+}
+
+// hedgeLeg is one copy of a hedged request. Each leg records its attempts on
+// its own copy of the trace entry, merged back once the race is decided.
+type hedgeLeg struct {
+	entry  trace.Entry
+	hedge  bool
+	cancel context.CancelCauseFunc
+	res    *upstreamResult
+	err    error
+}
+
+// tryHedged sends req to the targets like tryTargets. For hedgeable
+// SOAPActions, a second copy is sent if no response has arrived after the
+// hedge delay; the first response wins and the other copy is cancelled. The
+// copy needs a concurrency slot of its own and is not sent when none is free.
+func (t *LoggingTransport) tryHedged(req *http.Request, body []byte, targets []*Upstream, entry *trace.Entry, try int) (*upstreamResult, error) {
+	policy := t.Hedges[entry.SOAPAction]
+	if policy == nil {
+		return t.tryTargets(req, body, targets, entry, try)
+	}
+
+	done := make(chan *hedgeLeg, 2)
+	var legs []*hedgeLeg
+	launch := func(hedge bool, release func()) {
+		ctx, cancel := context.WithCancelCause(req.Context())
+		leg := &hedgeLeg{entry: *entry, hedge: hedge, cancel: cancel}
+		leg.entry.Attempts = nil
+		legs = append(legs, leg)
+		start := time.Now()
+		go func() {
+			defer release()
+			leg.res, leg.err = t.tryTargets(req.WithContext(ctx), body, targets, &leg.entry, try)
+			if leg.err == nil {
+				policy.observe(time.Since(start))
+			}
+			done <- leg
+		}()
+	}
+
+	// The first copy runs in the slot taken by dispatch.
+	launch(false, func() {})
+	timer := time.NewTimer(policy.hedgeDelay())
+	defer timer.Stop()
+
+	var winner *hedgeLeg
+	finished := make(map[*hedgeLeg]bool, 2)
+	for pending := 1; pending > 0 && winner == nil; {
+		select {
+		case <-timer.C:
+			if release, ok := t.Bulkheads.tryAcquire(entry.SOAPAction); ok {
+				launch(true, release)
+				pending++
+			}
+		case leg := <-done:
+			pending--
+			finished[leg] = true
+			// A failed copy only decides the race when no other copy is
+			// running; failures are left to the retry policy, not hedged.
+			if leg.err == nil || pending == 0 {
+				winner = leg
+			}
+		}
+	}
+
+	for _, leg := range legs {
+		if leg != winner {
+			leg.cancel(errHedgeLost)
+			if !finished[leg] {
+				<-done
+			}
+		}
+		leg.cancel(nil)
+	}
+
+	t.mergeHedge(entry, legs, winner)
+	return winner.res, winner.err
+}
+
+// mergeHedge copies the attempts of every leg onto entry, in the order they
+// started, and takes the upstream details from the winning leg.
+func (t *LoggingTransport) mergeHedge(entry *trace.Entry, legs []*hedgeLeg, winner *hedgeLeg) {
+	var attempts []trace.Attempt
+	for _, leg := range legs {
+		for i, a := range leg.entry.Attempts {
+			a.Hedge = leg.hedge
+			a.Winner = len(legs) > 1 && leg == winner && i == len(leg.entry.Attempts)-1
+			attempts = append(attempts, a)
+		}
+	}
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].StartedAt.Before(attempts[j].StartedAt) })
+	entry.Attempts = append(entry.Attempts, attempts...)
+	if len(legs) > 1 {
+		entry.Hedged = true
+	}
+
+	w := &winner.entry
+	entry.Upstream = w.Upstream
+	entry.UpstreamURL = w.UpstreamURL
+	entry.Path = w.Path
+	entry.Host = w.Host
+	entry.UpstreamReqHeaders = w.UpstreamReqHeaders
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"soap-proxy/internal/config"
+	"soap-proxy/internal/trace"
+)
+
+// redactedValue replaces secrets in traces.
+const redactedValue = "[redacted]"
+
+// CallerIdentity passes the identity of the caller to the upstreams in
+// headers, replacing any copies of those headers sent by the client.
+type CallerIdentity struct {
+	cfg config.CallerIdentityConfig
+}
+
+// newCallerIdentity builds a CallerIdentity from config, or returns nil when
+// neither identity headers nor API keys are configured.
+func newCallerIdentity(cfg config.CallerIdentityConfig) *CallerIdentity {
+	if cfg.SubjectHeader == "" && cfg.SANsHeader == "" && cfg.FingerprintHeader == "" && len(cfg.APIKeys) == 0 {
+		return nil
+	}
+	return &CallerIdentity{cfg: cfg}
+}
+
+// identify returns who sent req: the verified client certificate when the
+// listener uses mTLS, and the name of the API key presented, if it is known.
+// It returns nil when neither is present.
+func (c *CallerIdentity) identify(req *http.Request) *trace.Caller {
+	caller := &trace.Caller{}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cert := req.TLS.VerifiedChains[0][0]
+		sum := sha256.Sum256(cert.Raw)
+		caller.Subject = cert.Subject.String()
+		caller.Fingerprint = hex.EncodeToString(sum[:])
+		caller.SANs = append(caller.SANs, cert.DNSNames...)
+		caller.SANs = append(caller.SANs, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			caller.SANs = append(caller.SANs, ip.String())
+		}
+		for _, u := range cert.URIs {
+			caller.SANs = append(caller.SANs, u.String())
+		}
+	}
+	if c != nil && len(c.cfg.APIKeys) > 0 {
+		caller.APIKey = c.apiKeyName(req.Header.Get(c.cfg.APIKeyHeader))
+	}
+	if caller.Subject == "" && caller.APIKey == "" {
+		return nil
+	}
+	return caller
+}
+
+// apiKeyName returns the name of key, or "" when it is not a known key. Every
+// key is compared, in constant time, so the timing does not reveal which
+// ones are close.
+func (c *CallerIdentity) apiKeyName(key string) string {
+	if key == "" {
+		return ""
+	}
+	name := ""
+	for _, k := range c.cfg.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			name = k.Name
+		}
+	}
+	return name
+}
+
+// apply removes the identity headers sent by the client and sets them from
+// caller, which may be nil. The API key itself is meant for the proxy and is
+// not passed on.
+func (c *CallerIdentity) apply(header http.Header, caller *trace.Caller) {
+	if c == nil {
+		return
+	}
+	if len(c.cfg.APIKeys) > 0 {
+		header.Del(c.cfg.APIKeyHeader)
+	}
+	for _, h := range []struct{ name, value string }{
+		{c.cfg.SubjectHeader, callerField(caller, func(c *trace.Caller) string { return c.Subject })},
+		{c.cfg.SANsHeader, callerField(caller, func(c *trace.Caller) string { return strings.Join(c.SANs, ", ") })},
+		{c.cfg.FingerprintHeader, callerField(caller, func(c *trace.Caller) string { return c.Fingerprint })},
+		{c.cfg.APIKeyNameHeader, callerField(caller, func(c *trace.Caller) string { return c.APIKey })},
+	} {
+		if h.name == "" {
+			continue
+		}
+		header.Del(h.name)
+		if h.value != "" {
+			header.Set(h.name, h.value)
+		}
+	}
+}
+
+// cacheKey returns the part of the cache and coalescing keys identifying
+// caller. It is empty when no identity headers are sent, as the upstreams
+// then cannot tell callers apart.
+func (c *CallerIdentity) cacheKey(caller *trace.Caller) string {
+	if c == nil || caller == nil {
+		return ""
+	}
+	if c.cfg.SubjectHeader == "" && c.cfg.SANsHeader == "" && c.cfg.FingerprintHeader == "" && c.cfg.APIKeyNameHeader == "" {
+		return ""
+	}
+	return caller.Fingerprint + "|" + caller.APIKey
+}
+
+// redact hides the API key in header, a copy of the client's headers kept
+// for the trace.
+func (c *CallerIdentity) redact(header http.Header) http.Header {
+	if c == nil || len(c.cfg.APIKeys) == 0 || header.Get(c.cfg.APIKeyHeader) == "" {
+		return header
+	}
+	header.Set(c.cfg.APIKeyHeader, redactedValue)
+	return header
+}
+
+func callerField(caller *trace.Caller, field func(*trace.Caller) string) string {
+	if caller == nil {
+		return ""
+	}
+	return field(caller)
+}
+
+// callerMatches reports whether any part of the caller's identity contains
+// q, ignoring case.
+func callerMatches(caller *trace.Caller, q string) bool {
+	if caller == nil {
+		return false
+	}
+	q = strings.ToLower(q)
+	fields := append([]string{caller.Subject, caller.Fingerprint, caller.APIKey}, caller.SANs...)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), q) {
+			return true
+		}
+	}
+	return false
+}
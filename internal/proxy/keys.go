@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// CredentialFiles locates the client certificate and key, either as PEM
+// files or as a PKCS#12 bundle, and the CA bundle trusted for upstream
+// servers. The passphrase of a PKCS#12 bundle or of an encrypted PKCS#8 key
+// is read from PassphraseFile or the environment variable PassphraseEnv.
+type CredentialFiles struct {
+	CertFile       string
+	KeyFile        string
+	PKCS12File     string
+	CAFile         string
+	PassphraseFile string
+	PassphraseEnv  string
+}
+
+// paths returns the files to watch for changes.
+func (f CredentialFiles) paths() []string {
+	var paths []string
+	if f.PKCS12File != "" {
+		paths = append(paths, f.PKCS12File)
+	} else {
+		paths = append(paths, f.CertFile, f.KeyFile)
+	}
+	paths = append(paths, f.CAFile)
+	if f.PassphraseFile != "" {
+		paths = append(paths, f.PassphraseFile)
+	}
+	return paths
+}
+
+// source names where the client certificate comes from, for logging.
+func (f CredentialFiles) source() string {
+	if f.PKCS12File != "" {
+		return f.PKCS12File
+	}
+	return f.CertFile
+}
+
+func (f CredentialFiles) passphrase() (string, error) {
+	switch {
+	case f.PassphraseFile != "":
+		b, err := os.ReadFile(f.PassphraseFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case f.PassphraseEnv != "":
+		p, ok := os.LookupEnv(f.PassphraseEnv)
+		if !ok {
+			return "", fmt.Errorf("passphrase variable %s is not set", f.PassphraseEnv)
+		}
+		return p, nil
+	}
+	return "", nil
+}
+
+// keyPair loads the client certificate and its private key.
+func (f CredentialFiles) keyPair() (tls.Certificate, error) {
+	pass, err := f.passphrase()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if f.PKCS12File != "" {
+		return loadPKCS12(f.PKCS12File, pass)
+	}
+
+	certPEM, err := os.ReadFile(f.CertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(f.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if keyPEM, err = decryptKeyPEM(keyPEM, pass); err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", f.KeyFile, err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// loadPKCS12 loads the certificate, key and any intermediate certificates of
+// a PKCS#12 bundle.
+func loadPKCS12(path, pass string) (tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, intermediates, err := pkcs12.DecodeChain(data, pass)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", path, err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range intermediates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// decryptKeyPEM replaces an encrypted PKCS#8 key with its decrypted form, so
+// tls.X509KeyPair can parse it. Other keys are returned as they are.
+func decryptKeyPEM(keyPEM []byte, pass string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return keyPEM, nil
+	}
+	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, errors.New("legacy PEM encryption is not supported, convert the key to encrypted PKCS#8")
+	}
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return keyPEM, nil
+	}
+	if pass == "" {
+		return nil, errors.New("key is encrypted but no passphrase is configured")
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(pass))
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"soap-proxy/internal/config"
+)
+
+// serverTLSConfig builds the TLS config of a listener, or returns nil when
+// the listener serves plain HTTP.
+func serverTLSConfig(c config.ListenerTLSConfig) (*tls.Config, error) {
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		caBytes, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serve runs srv with TLS when it has a TLS config, and plain HTTP otherwise.
+func serve(name string, srv *http.Server) error {
+	switch {
+	case srv.TLSConfig == nil:
+		log.Printf("%s listening on %s", name, srv.Addr)
+		return srv.ListenAndServe()
+	case srv.TLSConfig.ClientCAs != nil:
+		log.Printf("%s listening on %s (mTLS)", name, srv.Addr)
+	default:
+		log.Printf("%s listening on %s (TLS)", name, srv.Addr)
+	}
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+// Maintenance answers requests with a configured SOAP Fault instead of
+// forwarding them, when switched on through the admin API or during a
+// scheduled window.
+type Maintenance struct {
+	fault   soapFault
+	windows []maintenanceWindow
+
+	mu        sync.Mutex
+	enabled   bool
+	actions   map[string]bool // nil means all SOAPActions
+	changedAt time.Time
+}
+
+type maintenanceWindow struct {
+	start, end time.Time
+	actions    map[string]bool
+}
+
+// MaintenanceStatus is the API view of maintenance mode.
+type MaintenanceStatus struct {
+	// Active reports whether maintenance applies right now, manually or by schedule.
+	Active      bool                      `json:"active"`
+	Enabled     bool                      `json:"enabled"`
+	SOAPActions []string                  `json:"soapActions,omitempty"`
+	ChangedAt   time.Time                 `json:"changedAt"`
+	Windows     []MaintenanceWindowStatus `json:"windows"`
+}
+
+// MaintenanceWindowStatus is the API view of a scheduled maintenance window.
+type MaintenanceWindowStatus struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	SOAPActions []string  `json:"soapActions,omitempty"`
+	Active      bool      `json:"active"`
+}
+
+// MaintenanceUpdate is the body accepted by the admin API.
+type MaintenanceUpdate struct {
+	Enabled     bool     `json:"enabled"`
+	SOAPActions []string `json:"soapActions"`
+}
+
+// newMaintenance builds Maintenance from config. It is never nil, so the
+// admin API can switch maintenance on even when none is configured.
+func newMaintenance(cfg config.MaintenanceConfig) *Maintenance {
+	m := &Maintenance{
+		fault: soapFault{
+			Status:     cfg.Fault.Status,
+			Code:       cfg.Fault.Code,
+			Reason:     cfg.Fault.String,
+			Detail:     cfg.Fault.Detail,
+			RetryAfter: cfg.Fault.RetryAfterSeconds,
+		},
+		enabled:   cfg.Enabled,
+		actions:   actionSet(cfg.SOAPActions),
+		changedAt: time.Now(),
+	}
+	for _, w := range cfg.Windows {
+		actions := actionSet(w.SOAPActions)
+		if actions == nil {
+			actions = m.actions
+		}
+		m.windows = append(m.windows, maintenanceWindow{start: w.Start, end: w.End, actions: actions})
+	}
+	return m
+}
+
+func actionSet(actions []string) map[string]bool {
+	if len(actions) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(actions))
+	for _, a := range actions {
+		set[a] = true
+	}
+	return set
+}
+
+func actionList(set map[string]bool) []string {
+	var out []string
+	for a := range set {
+		out = append(out, a)
+	}
+	return out
+}
+
+// check returns a rejectedError when action is under maintenance. Within a
+// scheduled window without a configured Retry-After, clients are told to
+// come back when the window ends.
+func (m *Maintenance) check(action string) error {
+	if m == nil {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	manual := m.enabled && (m.actions == nil || m.actions[action])
+	m.mu.Unlock()
+	if manual {
+		return m.reject(action, m.fault)
+	}
+	for _, w := range m.windows {
+		if now.Before(w.start) || !now.Before(w.end) || (w.actions != nil && !w.actions[action]) {
+			continue
+		}
+		fault := m.fault
+		if fault.RetryAfter == 0 {
+			fault.RetryAfter = int(math.Ceil(w.end.Sub(now).Seconds()))
+		}
+		return m.reject(action, fault)
+	}
+	return nil
+}
+
+func (m *Maintenance) reject(action string, fault soapFault) error {
+	return &rejectedError{
+		kind:  errKindMaintenance,
+		msg:   fmt.Sprintf("maintenance mode: %s not forwarded", action),
+		fault: fault,
+	}
+}
+
+// Set switches manual maintenance on or off, for all SOAPActions or only the
+// listed ones.
+func (m *Maintenance) Set(u MaintenanceUpdate) {
+	m.mu.Lock()
+	m.enabled = u.Enabled
+	m.actions = actionSet(u.SOAPActions)
+	m.changedAt = time.Now()
+	m.mu.Unlock()
+
+	scope := "all SOAPActions"
+	if len(u.SOAPActions) > 0 {
+		scope = strings.Join(u.SOAPActions, ", ")
+	}
+	if u.Enabled {
+		log.Printf("Maintenance mode enabled for %s", scope)
+	} else {
+		log.Printf("Maintenance mode disabled")
+	}
+}
+
+// Status reports the manual state and the scheduled windows.
+func (m *Maintenance) Status() MaintenanceStatus {
+	now := time.Now()
+	m.mu.Lock()
+	st := MaintenanceStatus{
+		Active:      m.enabled,
+		Enabled:     m.enabled,
+		SOAPActions: actionList(m.actions),
+		ChangedAt:   m.changedAt,
+		Windows:     []MaintenanceWindowStatus{},
+	}
+	m.mu.Unlock()
+
+	for _, w := range m.windows {
+		active := !now.Before(w.start) && now.Before(w.end)
+		st.Active = st.Active || active
+		st.Windows = append(st.Windows, MaintenanceWindowStatus{
+			Start:       w.start,
+			End:         w.end,
+			SOAPActions: actionList(w.actions),
+			Active:      active,
+		})
+	}
+	return st
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"soap-proxy/internal/config"
+	"soap-proxy/internal/trace"
+)
+
+// Mirror replays a sample of requests to a shadow upstream.
+type Mirror struct {
+	upstream *Upstream
+	percent  int
+	actions  map[string]bool
+	timeout  time.Duration
+}
+
+// newMirror builds a Mirror from config, or returns nil when mirroring is off.
+func newMirror(cfg config.MirrorConfig, router *Router) *Mirror {
+	if cfg.Upstream == "" {
+		return nil
+	}
+	m := &Mirror{
+		upstream: router.upstream(cfg.Upstream),
+		percent:  cfg.Percent,
+		timeout:  time.Duration(cfg.TimeoutMs) * time.Millisecond,
+	}
+	if len(cfg.SOAPActions) > 0 {
+		m.actions = make(map[string]bool, len(cfg.SOAPActions))
+		for _, a := range cfg.SOAPActions {
+			m.actions[a] = true
+		}
+	}
+	return m
+}
+
+func (m *Mirror) sampled(action string) bool {
+	if m == nil || m.upstream == nil {
+		return false
+	}
+	if m.actions != nil && !m.actions[action] {
+		return false
+	}
+	return m.percent >= 100 || rand.Intn(100) < m.percent
+}
+
+// shadowCall is an in-progress request to the shadow upstream.
+type shadowCall struct {
+	done   chan struct{}
+	result trace.Shadow
+	body   []byte
+}
+
+// startShadow sends a copy of req to the shadow upstream in the background,
+// independently of the client's context. It returns nil when the request is
+// not sampled.
+func (t *LoggingTransport) startShadow(req *http.Request, body []byte, action string) *shadowCall {
+	if !t.Mirror.sampled(action) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Mirror.timeout)
+	out := req.Clone(ctx)
+	out.Body = io.NopCloser(bytes.NewReader(body))
+
+	call := &shadowCall{
+		done:   make(chan struct{}),
+		result: trace.Shadow{Upstream: t.Mirror.upstream.Name},
+	}
+	go func() {
+		defer close(call.done)
+		defer cancel()
+
+		member := t.Mirror.upstream.pick()
+		if member == nil {
+			call.result.Error = errNoMembers.Error()
+			return
+		}
+		defer member.release()
+		member.rewrite(out)
+		call.result.URL = out.URL.String()
+
+		start := time.Now()
+		rt, _ := t.upstreamTransport("", t.Mirror.upstream.Name)
+		res, err := t.send(out, rt)
+		call.result.DurationMs = time.Since(start).Milliseconds()
+		if err != nil {
+			call.result.Error = err.Error()
+			call.result.ErrorKind = classifyError(err)
+			return
+		}
+		call.body = res.body
+		call.result.StatusCode = res.resp.StatusCode
+		call.result.Resp = trace.HTTPMessage{
+			Headers:   res.resp.Header.Clone(),
+			Body:      string(res.body),
+			Truncated: res.truncated,
+		}
+	}()
+	return call
+}
+
+// compare waits for the shadow call and flags differences from the primary response.
+func (c *shadowCall) compare(entry *trace.Entry) *trace.Shadow {
+	<-c.done
+	s := c.result
+	switch {
+	case s.Error != "" || entry.Error != "":
+		s.Differs = s.Error == "" || entry.Error == ""
+		if s.Differs {
+			s.Difference = "only one of primary and shadow failed"
+		}
+	case s.StatusCode != entry.StatusCode:
+		s.Differs = true
+		s.Difference = fmt.Sprintf("status %d vs shadow %d", entry.StatusCode, s.StatusCode)
+	default:
+		s.Difference = xmlDifference([]byte(entry.Resp.Body), c.body)
+		s.Differs = s.Difference != ""
+	}
+	return &s
+}
+
+// record stores the trace entry, after the shadow call completes if there is one.
+func (t *LoggingTransport) record(entry trace.Entry, shadow *shadowCall) {
+	if shadow == nil {
+		_ = t.Store.Add(entry)
+		return
+	}
+	go func() {
+		entry.Shadow = shadow.compare(&entry)
+		_ = t.Store.Add(entry)
+	}()
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+const (
+	balancerRoundRobin       = "round-robin"
+	balancerLeastOutstanding = "least-outstanding"
+	balancerWeighted         = "weighted"
+)
+
+// Member is one node of an upstream pool.
+type Member struct {
+	URL    *url.URL
+	Weight int
+
+	healthy     atomic.Bool
+	outstanding atomic.Int64
+
+	// guarded by the owning Upstream's mu
+	currentWeight int
+
+	checkMu   sync.Mutex
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+func newMember(rawURL string, weight int) (*Member, error) {
+	u, err := config.ParseUpstreamURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	m := &Member{URL: u, Weight: weight}
+	m.healthy.Store(true)
+	return m, nil
+}
+
+// rewrite points req at the member, joining the member path with the client path.
+func (m *Member) rewrite(req *http.Request) {
+	req.URL.Scheme = m.URL.Scheme
+	req.URL.Host = m.URL.Host
+	if m.URL.Path != "" && m.URL.Path != "/" {
+		req.URL.Path = singleJoiningSlash(m.URL.Path, req.URL.Path)
+	}
+	req.Host = m.URL.Host
+}
+
+// release marks a request picked from this member as finished.
+func (m *Member) release() {
+	m.outstanding.Add(-1)
+}
+
+// MemberStatus is the API view of a pool member.
+type MemberStatus struct {
+	URL         string    `json:"url"`
+	Weight      int       `json:"weight"`
+	Healthy     bool      `json:"healthy"`
+	Outstanding int64     `json:"outstanding"`
+	LastCheck   time.Time `json:"lastCheck"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// UpstreamStatus is the API view of an upstream pool.
+type UpstreamStatus struct {
+	Name      string           `json:"name"`
+	Balancer  string           `json:"balancer"`
+	Members   []MemberStatus   `json:"members"`
+	Discovery *DiscoveryStatus `json:"discovery,omitempty"`
+}
+
+// Upstream is a named pool of downstream SOAP endpoints.
+type Upstream struct {
+	Name     string
+	Balancer string
+
+	health    config.HealthCheckConfig
+	discovery config.DiscoveryConfig
+
+	mu      sync.RWMutex
+	members []*Member
+	next    atomic.Uint64
+
+	// guarded by mu
+	lastRefresh    time.Time
+	lastChange     time.Time
+	discoveryError string
+}
+
+func newUpstream(c config.UpstreamConfig) (*Upstream, error) {
+	u := &Upstream{Name: c.Name, Balancer: c.Balancer, health: c.HealthCheck, discovery: c.Discovery}
+	for _, mc := range c.Members {
+		m, err := newMember(mc.URL, mc.Weight)
+		if err != nil {
+			return nil, err
+		}
+		u.members = append(u.members, m)
+	}
+	return u, nil
+}
+
+// pick selects a member using the pool's balancer and counts it as outstanding.
+// Unhealthy members are skipped unless the whole pool is unhealthy.
+func (u *Upstream) pick() *Member {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	candidates := make([]*Member, 0, len(u.members))
+	for _, m := range u.members {
+		if m.healthy.Load() {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = u.members
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var chosen *Member
+	switch u.Balancer {
+	case balancerLeastOutstanding:
+		start := int(u.next.Add(1) % uint64(len(candidates)))
+		for i := range candidates {
+			m := candidates[(start+i)%len(candidates)]
+			if chosen == nil || m.outstanding.Load() < chosen.outstanding.Load() {
+				chosen = m
+			}
+		}
+	case balancerWeighted:
+		// smooth weighted round-robin
+		total := 0
+		for _, m := range candidates {
+			m.currentWeight += m.Weight
+			total += m.Weight
+			if chosen == nil || m.currentWeight > chosen.currentWeight {
+				chosen = m
+			}
+		}
+		chosen.currentWeight -= total
+	default:
+		chosen = candidates[int((u.next.Add(1)-1)%uint64(len(candidates)))]
+	}
+
+	chosen.outstanding.Add(1)
+	return chosen
+}
+
+// Status reports the current state of every member.
+func (u *Upstream) Status() UpstreamStatus {
+	st := UpstreamStatus{Name: u.Name, Balancer: u.Balancer}
+
+	u.mu.RLock()
+	members := append([]*Member(nil), u.members...)
+	if u.discovery.Type != "" {
+		st.Discovery = &DiscoveryStatus{
+			Type:        u.discovery.Type,
+			Source:      u.discoverySource(),
+			LastRefresh: u.lastRefresh,
+			LastChange:  u.lastChange,
+			LastError:   u.discoveryError,
+		}
+	}
+	u.mu.RUnlock()
+
+	for _, m := range members {
+		m.checkMu.Lock()
+		st.Members = append(st.Members, MemberStatus{
+			URL:         m.URL.String(),
+			Weight:      m.Weight,
+			Healthy:     m.healthy.Load(),
+			Outstanding: m.outstanding.Load(),
+			LastCheck:   m.lastCheck,
+			LastError:   m.lastError,
+		})
+		m.checkMu.Unlock()
+	}
+	return st
+}
@@ -1,16 +1,21 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"strconv"
+	"time"
 
 	"soap-proxy/internal/config"
 	"soap-proxy/internal/storage"
+	"soap-proxy/internal/trace"
 	"soap-proxy/internal/ui"
 )
 
@@ -39,11 +44,26 @@ func Run(cfg *config.Config) error {
 		return err
 	}
 
+	router, err := newRouter(cfg.Upstreams, cfg.Routes, upstreamURL)
+	if err != nil {
+		return err
+	}
+
 	actionHooks, err := newActionHooks(cfg.Hooks)
 	if err != nil {
 		return err
 	}
 
+	headerRules, err := newHeaderRules(cfg.HeaderRules)
+	if err != nil {
+		return err
+	}
+
+	cache, err := newResponseCache(cfg.Cache)
+	if err != nil {
+		return err
+	}
+
 	store, err := storage.NewFileTraceStore(traceFile, maxTraces)
 	if err != nil {
 		log.Printf("warning: failed to init file store (%v), traces will not persist", err)
@@ -51,25 +71,78 @@ func Run(cfg *config.Config) error {
 	}
 	defer store.Close()
 
-	baseTransport, err := NewMTLSTransport(certFile, keyFile, caFile)
+	egress, err := newEgressProxy(cfg.EgressProxy)
 	if err != nil {
 		return err
 	}
+	if egress != nil {
+		log.Printf("Upstream connections go through egress proxy %s", egress)
+	}
 
-	loggingTransport := NewLoggingTransport(baseTransport, store, actionHooks)
+	clientTLS, err := newClientTLS(cfg, CredentialFiles{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		PKCS12File:     cfg.ClientTLS.PKCS12File,
+		CAFile:         caFile,
+		PassphraseFile: cfg.ClientTLS.PassphraseFile,
+		PassphraseEnv:  cfg.ClientTLS.PassphraseEnv,
+	}, TransportOptions{
+		ConnectTimeout:      time.Duration(cfg.Timeouts.ConnectMs) * time.Millisecond,
+		TLSHandshakeTimeout: longestTLSHandshake(cfg.Timeouts),
+		Egress:              egress,
+		MaxIdleConns:        cfg.ConnectionPool.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.ConnectionPool.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     cfg.ConnectionPool.MaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(cfg.ConnectionPool.IdleConnTimeoutSeconds) * time.Second,
+		KeepAlive:           time.Duration(cfg.ConnectionPool.KeepAliveSeconds) * time.Second,
+		DisableKeepAlives:   cfg.ConnectionPool.DisableKeepAlives,
+		ForceAttemptHTTP2:   cfg.ConnectionPool.ForceAttemptHTTP2,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientTLS.watch(ctx, time.Duration(cfg.ClientTLS.ReloadIntervalSeconds)*time.Second)
+	for _, u := range router.upstreams {
+		u.startDiscovery(ctx)
+		u.startHealthChecks(ctx, clientTLS.profile("", u.Name).transport)
+	}
+
+	loggingTransport := NewLoggingTransport(clientTLS.def.transport, store, actionHooks, router)
+	loggingTransport.ClientTLS = clientTLS
+	loggingTransport.Retries = newRetryPolicies(cfg.Retries)
+	loggingTransport.Hedges = newHedgePolicies(cfg.Hedging)
+	loggingTransport.Breakers = newBreakerSet(cfg.CircuitBreaker)
+	loggingTransport.Timeouts = newTimeoutPolicy(cfg.Timeouts)
+	loggingTransport.Limits = newRateLimiter(cfg.RateLimits)
+	loggingTransport.Limits.startSweeper(ctx)
+	loggingTransport.Bulkheads = newBulkheads(cfg.Concurrency)
+	loggingTransport.Mirror = newMirror(cfg.Mirror, router)
+	loggingTransport.Headers = headerRules
+	loggingTransport.Cache = cache
+	loggingTransport.Coalescer = newCoalescer(cfg.Coalescing)
+	loggingTransport.Maintenance = newMaintenance(cfg.Maintenance)
+	loggingTransport.Identity = newCallerIdentity(cfg.CallerIdentity)
+	loggingTransport.Certs = newCertMonitor(clientTLS.creds, cfg.CertExpiry.WarningDays)
 
 	rp := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = upstreamURL.Scheme
-			req.URL.Host = upstreamURL.Host
-			if upstreamURL.Path != "" && upstreamURL.Path != "/" {
-				req.URL.Path = singleJoiningSlash(upstreamURL.Path, req.URL.Path)
-			}
-			req.Host = upstreamURL.Host
-		},
+		// The upstream is chosen in LoggingTransport, once the buffered body
+		// has yielded the SOAPAction.
+		Director:  func(req *http.Request) {},
 		Transport: loggingTransport,
 	}
 
+	proxyTLS, err := serverTLSConfig(cfg.ServerTLS.Proxy)
+	if err != nil {
+		return fmt.Errorf("proxy listener TLS: %w", err)
+	}
+	uiTLS, err := serverTLSConfig(cfg.ServerTLS.UI)
+	if err != nil {
+		return fmt.Errorf("UI listener TLS: %w", err)
+	}
+
 	// Proxy server (SOAP traffic + health)
 	go func() {
 		mux := http.NewServeMux()
@@ -78,16 +151,30 @@ func Run(cfg *config.Config) error {
 			w.WriteHeader(http.StatusOK)
 		})
 
-		log.Printf("Proxy listening on %s, forwarding to %s", proxyListen, upstreamStr)
-		if err := http.ListenAndServe(proxyListen, mux); err != nil {
+		log.Printf("Default upstream %s", router.fallback.Upstream.Name)
+		srv := &http.Server{Addr: proxyListen, Handler: mux, TLSConfig: proxyTLS}
+		if err := serve("Proxy", srv); err != nil {
 			log.Fatalf("proxy failed: %v", err)
 		}
 	}()
 
-	// UI / API server
+	// UI / API server, also answering health checks so probes need no client
+	// certificate when the proxy listener requires one
 	muxUI := http.NewServeMux()
+	muxUI.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
 	muxUI.HandleFunc("/api/traces", func(w http.ResponseWriter, r *http.Request) {
 		traces := store.List()
+		if q := r.URL.Query().Get("caller"); q != "" {
+			matched := []trace.Entry{}
+			for _, e := range traces {
+				if callerMatches(e.Caller, q) {
+					matched = append(matched, e)
+				}
+			}
+			traces = matched
+		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(traces)
 	})
@@ -101,10 +188,70 @@ func Run(cfg *config.Config) error {
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(tr)
 	})
+	muxUI.HandleFunc("/api/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(router.Upstreams())
+	})
+	muxUI.HandleFunc("/api/variants", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(variantStats(store.List()))
+	})
+	muxUI.HandleFunc("/api/breakers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(loggingTransport.Breakers.Status())
+	})
+	muxUI.HandleFunc("/api/cache", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(cache.Status())
+		case http.MethodDelete:
+			purged := cache.Purge(r.URL.Query().Get("soapAction"))
+			_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	muxUI.HandleFunc("/api/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			// Browsers cannot send JSON cross-site without a preflight, so
+			// other pages cannot switch maintenance on.
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			var u MaintenanceUpdate
+			if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			loggingTransport.Maintenance.Set(u)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(loggingTransport.Maintenance.Status())
+	})
+	muxUI.HandleFunc("/api/certs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(clientTLS.Status())
+	})
+	muxUI.HandleFunc("/api/certs/expiry", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(loggingTransport.Certs.Status())
+	})
+	muxUI.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		loggingTransport.Certs.WriteMetrics(w)
+	})
 	muxUI.HandleFunc("/", ui.Handler)
 
-	log.Printf("UI listening on %s", uiListen)
-	return http.ListenAndServe(uiListen, muxUI)
+	return serve("UI", &http.Server{Addr: uiListen, Handler: muxUI, TLSConfig: uiTLS})
 }
 
 func singleJoiningSlash(a, b string) string {
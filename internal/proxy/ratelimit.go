@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+const (
+	clientKeyIP          = "ip"
+	clientKeyHeader      = "header"
+	clientKeyCertSubject = "certSubject"
+
+	bucketIdleTimeout = 10 * time.Minute
+)
+
+// RateLimiter enforces token-bucket limits on inbound requests.
+type RateLimiter struct {
+	rules []*rateLimitRule
+}
+
+type rateLimitRule struct {
+	config.RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter builds a RateLimiter from config, or returns nil when no limits are set.
+func newRateLimiter(cfgs []config.RateLimitConfig) *RateLimiter {
+	if len(cfgs) == 0 {
+		return nil
+	}
+	l := &RateLimiter{}
+	for _, c := range cfgs {
+		l.rules = append(l.rules, &rateLimitRule{RateLimitConfig: c, buckets: make(map[string]*tokenBucket)})
+	}
+	return l
+}
+
+// allow takes a token from every rule that applies to the request, returning
+// a rejectedError for the first rule whose bucket is empty. The tokens taken
+// from the other rules are then given back, so rejected requests do not
+// drain limits shared with other callers.
+func (l *RateLimiter) allow(req *http.Request, action string) error {
+	if l == nil {
+		return nil
+	}
+	type taken struct {
+		rule *rateLimitRule
+		key  string
+	}
+	var held []taken
+	now := time.Now()
+	for _, r := range l.rules {
+		if r.SOAPAction != "" && r.SOAPAction != action {
+			continue
+		}
+		key := r.bucketKey(req, action)
+		if wait, ok := r.take(key, now); !ok {
+			for _, t := range held {
+				t.rule.refund(t.key)
+			}
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			return &rejectedError{
+				kind: errKindRateLimited,
+				msg:  fmt.Sprintf("rate limit %s exceeded for %q", r.Name, key),
+				fault: soapFault{
+					Status:     http.StatusTooManyRequests,
+					Code:       faultCodeClient,
+					Reason:     "Rate limit exceeded",
+					Detail:     r.Name,
+					RetryAfter: retryAfter,
+				},
+			}
+		}
+		held = append(held, taken{r, key})
+	}
+	return nil
+}
+
+// bucketKey identifies the bucket a request draws from within the rule.
+func (r *rateLimitRule) bucketKey(req *http.Request, action string) string {
+	var client string
+	switch r.ClientKey {
+	case clientKeyIP:
+		client = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			client = host
+		}
+	case clientKeyHeader:
+		client = req.Header.Get(r.Header)
+	case clientKeyCertSubject:
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			client = req.TLS.PeerCertificates[0].Subject.String()
+		}
+	}
+	if r.PerSOAPAction {
+		return client + "|" + action
+	}
+	return client
+}
+
+// take removes a token from the bucket for key. When none is left it returns
+// how long until the next token is available.
+func (r *rateLimitRule) take(key string, now time.Time) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(r.Burst), last: now}
+		r.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.RatePerSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / r.RatePerSecond * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// refund gives back a token taken for key.
+func (r *rateLimitRule) refund(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.buckets[key]; ok {
+		b.tokens = math.Min(float64(r.Burst), b.tokens+1)
+	}
+}
+
+// startSweeper periodically drops buckets that have been idle long enough to
+// be full again, so per-client state does not grow without bound.
+func (l *RateLimiter) startSweeper(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, r := range l.rules {
+					r.sweep(now)
+				}
+			}
+		}
+	}()
+}
+
+func (r *rateLimitRule) sweep(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, b := range r.buckets {
+		if now.Sub(b.last) > bucketIdleTimeout {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+// RetryPolicy decides whether and when a failed call to an upstream is retried.
+type RetryPolicy struct {
+	SOAPAction       string
+	MaxAttempts      int
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	multiplier       float64
+	statuses         map[int]bool
+	faultCodes       []string
+	connectionErrors bool
+}
+
+// newRetryPolicies builds RetryPolicies from config, keyed by SOAPAction.
+func newRetryPolicies(cfgs []config.RetryConfig) map[string]*RetryPolicy {
+	policies := make(map[string]*RetryPolicy, len(cfgs))
+	for _, c := range cfgs {
+		p := &RetryPolicy{
+			SOAPAction:       c.SOAPAction,
+			MaxAttempts:      c.MaxAttempts,
+			initialBackoff:   time.Duration(c.InitialBackoffMs) * time.Millisecond,
+			maxBackoff:       time.Duration(c.MaxBackoffMs) * time.Millisecond,
+			multiplier:       c.BackoffMultiplier,
+			statuses:         make(map[int]bool, len(c.RetryOnStatus)),
+			faultCodes:       c.RetryOnFaultCodes,
+			connectionErrors: c.RetryOnConnectionErrors,
+		}
+		for _, code := range c.RetryOnStatus {
+			p.statuses[code] = true
+		}
+		policies[c.SOAPAction] = p
+	}
+	return policies
+}
+
+// retryable reports whether the outcome of an attempt warrants another try.
+func (p *RetryPolicy) retryable(res *upstreamResult, err error) bool {
+	if err != nil {
+		if !p.connectionErrors {
+			return false
+		}
+		switch kind := classifyError(err); kind {
+		case errKindDial, errKindTLS, errKindConnectionReset, errKindNoMembers:
+			return true
+		default:
+			return isTimeoutKind(kind)
+		}
+	}
+	if p.statuses[res.resp.StatusCode] {
+		return true
+	}
+	if len(p.faultCodes) > 0 {
+		if code := soapFaultCode(res.body); code != "" {
+			for _, want := range p.faultCodes {
+				if faultCodeMatches(code, want) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before try n+1, growing exponentially up to the maximum.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := float64(p.initialBackoff)
+	for i := 1; i < n; i++ {
+		d *= p.multiplier
+		if d >= float64(p.maxBackoff) {
+			return p.maxBackoff
+		}
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+
+	"soap-proxy/internal/config"
+)
+
+// pathRewrite maps the client path to the path joined with the upstream URL.
+type pathRewrite struct {
+	stripPrefix string
+	rules       []pathRule
+	fixed       string
+}
+
+type pathRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// newPathRewrite builds the route's path rewrite, or returns nil when the
+// client path is forwarded as is.
+func newPathRewrite(c config.RouteConfig) (*pathRewrite, error) {
+	if c.StripPrefix == "" && len(c.PathRewrites) == 0 && c.UpstreamPath == "" {
+		return nil, nil
+	}
+	p := &pathRewrite{stripPrefix: c.StripPrefix, fixed: c.UpstreamPath}
+	for _, r := range c.PathRewrites {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, pathRule{match: re, replace: r.Replace})
+	}
+	return p, nil
+}
+
+// apply strips the prefix and then runs each rewrite rule in order. A fixed
+// upstream path overrides both.
+func (p *pathRewrite) apply(path string) string {
+	if p == nil {
+		return path
+	}
+	if p.fixed != "" {
+		return p.fixed
+	}
+	if p.stripPrefix != "" && strings.HasPrefix(path, p.stripPrefix) {
+		path = path[len(p.stripPrefix):]
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	for _, r := range p.rules {
+		path = r.match.ReplaceAllString(path, r.replace)
+	}
+	return path
+}
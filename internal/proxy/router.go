@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"soap-proxy/internal/config"
+)
+
+const defaultRouteName = "default"
+
+// Route maps requests matching all of its set criteria to an upstream.
+type Route struct {
+	Name        string
+	SOAPAction  string
+	PathPrefix  string
+	Header      string
+	HeaderValue string
+	Upstream    *Upstream
+	Fallbacks   []*Upstream
+
+	// Variants split traffic between upstreams by weight; StickyHeader keeps
+	// requests sharing its value on the same variant.
+	Variants     []*Variant
+	StickyHeader string
+	totalWeight  int
+
+	rewrite *pathRewrite
+}
+
+// Variant is one weighted share of a route's traffic.
+type Variant struct {
+	Name     string
+	Upstream *Upstream
+	Weight   int
+}
+
+// selectUpstream returns the upstream serving req and, for routes with
+// variants, the name of the variant chosen.
+func (r *Route) selectUpstream(req *http.Request) (*Upstream, string) {
+	if len(r.Variants) == 0 {
+		return r.Upstream, ""
+	}
+
+	var n int
+	if v := req.Header.Get(r.StickyHeader); r.StickyHeader != "" && v != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(v))
+		n = int(h.Sum32() % uint32(r.totalWeight))
+	} else {
+		n = rand.Intn(r.totalWeight)
+	}
+	for _, v := range r.Variants {
+		if n < v.Weight {
+			return v.Upstream, v.Name
+		}
+		n -= v.Weight
+	}
+	last := r.Variants[len(r.Variants)-1]
+	return last.Upstream, last.Name
+}
+
+// targets lists the upstreams to try, primary first, then the route's fallbacks.
+func (r *Route) targets(primary *Upstream) []*Upstream {
+	return append([]*Upstream{primary}, r.Fallbacks...)
+}
+
+func (r *Route) matches(req *http.Request, action string) bool {
+	if r.SOAPAction != "" && r.SOAPAction != action {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.Header != "" {
+		v := req.Header.Get(r.Header)
+		if v == "" || (r.HeaderValue != "" && v != r.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// Router picks the first matching route, or the default route when none match.
+type Router struct {
+	routes    []*Route
+	fallback  *Route
+	upstreams []*Upstream
+}
+
+// newRouter builds a Router from config. When no default route is configured,
+// requests that match nothing are sent to defaultURL.
+func newRouter(upCfgs []config.UpstreamConfig, routeCfgs []config.RouteConfig, defaultURL *url.URL) (*Router, error) {
+	r := &Router{}
+	upstreams := make(map[string]*Upstream, len(upCfgs))
+	for _, c := range upCfgs {
+		u, err := newUpstream(c)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", c.Name, err)
+		}
+		upstreams[c.Name] = u
+		r.upstreams = append(r.upstreams, u)
+	}
+
+	for _, c := range routeCfgs {
+		route := &Route{
+			Name:        c.Name,
+			SOAPAction:  c.SOAPAction,
+			PathPrefix:  c.PathPrefix,
+			Header:      c.Header,
+			HeaderValue: c.HeaderValue,
+			Upstream:    upstreams[c.Upstream],
+		}
+		for _, name := range c.Fallbacks {
+			route.Fallbacks = append(route.Fallbacks, upstreams[name])
+		}
+		for _, v := range c.Variants {
+			route.Variants = append(route.Variants, &Variant{Name: v.Name, Upstream: upstreams[v.Upstream], Weight: v.Weight})
+			route.totalWeight += v.Weight
+		}
+		route.StickyHeader = c.StickyHeader
+		rewrite, err := newPathRewrite(c)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", c.Name, err)
+		}
+		route.rewrite = rewrite
+		if route.Upstream == nil && len(route.Variants) > 0 {
+			route.Upstream = route.Variants[0].Upstream
+		}
+		if c.Default {
+			r.fallback = route
+			continue
+		}
+		r.routes = append(r.routes, route)
+	}
+
+	if r.fallback == nil {
+		m := &Member{URL: defaultURL, Weight: 1}
+		m.healthy.Store(true)
+		u := &Upstream{Name: defaultRouteName, Balancer: balancerRoundRobin, members: []*Member{m}}
+		r.upstreams = append(r.upstreams, u)
+		r.fallback = &Route{Name: defaultRouteName, Upstream: u}
+	}
+	return r, nil
+}
+
+// Match returns the route for a request with the given SOAPAction.
+func (r *Router) Match(req *http.Request, action string) *Route {
+	for _, route := range r.routes {
+		if route.matches(req, action) {
+			return route
+		}
+	}
+	return r.fallback
+}
+
+// Upstreams reports the status of every upstream pool.
+func (r *Router) Upstreams() []UpstreamStatus {
+	out := make([]UpstreamStatus, 0, len(r.upstreams))
+	for _, u := range r.upstreams {
+		out = append(out, u.Status())
+	}
+	return out
+}
+
+// upstream returns the upstream with the given name, or nil.
+func (r *Router) upstream(name string) *Upstream {
+	for _, u := range r.upstreams {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+	soap12MediaType = "application/soap+xml"
+
+	// Generic fault codes, mapped to Client/Server (1.1) or Sender/Receiver (1.2).
+	faultCodeClient = "Client"
+	faultCodeServer = "Server"
+)
+
+// soapFault is a fault generated by the proxy itself rather than the upstream.
+type soapFault struct {
+	Status     int
+	Code       string
+	Reason     string
+	Detail     string
+	RetryAfter int // seconds, 0 to omit the header
+}
+
+// isSOAP12 reports whether req uses SOAP 1.2, judged by its Content-Type.
+func isSOAP12(req *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mt == soap12MediaType
+}
+
+// body renders the fault as a SOAP 1.1 or 1.2 envelope.
+func (f soapFault) body(soap12 bool) []byte {
+	var b bytes.Buffer
+	if soap12 {
+		code := f.Code
+		switch code {
+		case faultCodeClient:
+			code = "soap:Sender"
+		case faultCodeServer:
+			code = "soap:Receiver"
+		}
+		fmt.Fprintf(&b, `<?xml version="1.0" encoding="utf-8"?><soap:Envelope xmlns:soap="%s"><soap:Body><soap:Fault>`, soap12Namespace)
+		b.WriteString("<soap:Code><soap:Value>" + escapeXML(code) + "</soap:Value></soap:Code>")
+		b.WriteString(`<soap:Reason><soap:Text xml:lang="en">` + escapeXML(f.Reason) + "</soap:Text></soap:Reason>")
+		if f.Detail != "" {
+			b.WriteString("<soap:Detail>" + escapeXML(f.Detail) + "</soap:Detail>")
+		}
+	} else {
+		code := f.Code
+		if code == faultCodeClient || code == faultCodeServer {
+			code = "soap:" + code
+		}
+		fmt.Fprintf(&b, `<?xml version="1.0" encoding="utf-8"?><soap:Envelope xmlns:soap="%s"><soap:Body><soap:Fault>`, soap11Namespace)
+		b.WriteString("<faultcode>" + escapeXML(code) + "</faultcode>")
+		b.WriteString("<faultstring>" + escapeXML(f.Reason) + "</faultstring>")
+		if f.Detail != "" {
+			b.WriteString("<detail>" + escapeXML(f.Detail) + "</detail>")
+		}
+	}
+	b.WriteString("</soap:Fault></soap:Body></soap:Envelope>")
+	return b.Bytes()
+}
+
+// result builds the response the proxy returns in place of an upstream answer.
+func (f soapFault) result(req *http.Request) *upstreamResult {
+	soap12 := isSOAP12(req)
+	body := f.body(soap12)
+
+	header := make(http.Header)
+	if soap12 {
+		header.Set("Content-Type", soap12MediaType+"; charset=utf-8")
+	} else {
+		header.Set("Content-Type", "text/xml; charset=utf-8")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if f.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(f.RetryAfter))
+	}
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	return &upstreamResult{resp: resp, body: body}
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// soapFaultCode returns the fault code of a SOAP 1.1 (faultcode) or SOAP 1.2
+// (Code/Value) Fault in body, or "" when body is not a fault.
+func soapFaultCode(body []byte) string {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	inFault, inCode := false, false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case !inFault:
+			inFault = se.Name.Local == "Fault"
+		case se.Name.Local == "faultcode" || (inCode && se.Name.Local == "Value"):
+			var code string
+			if err := dec.DecodeElement(&code, &se); err != nil {
+				return ""
+			}
+			return strings.TrimSpace(code)
+		case se.Name.Local == "Code":
+			inCode = true
+		}
+	}
+}
+
+// faultCodeMatches reports whether code equals want, comparing only the local
+// part when want has no namespace prefix ("Server" matches "soap:Server").
+func faultCodeMatches(code, want string) bool {
+	if code == want {
+		return true
+	}
+	if strings.Contains(want, ":") {
+		return false
+	}
+	if i := strings.LastIndex(code, ":"); i >= 0 {
+		return code[i+1:] == want
+	}
+	return false
+}
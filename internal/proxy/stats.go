@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"sort"
+
+	"soap-proxy/internal/trace"
+)
+
+// VariantStats summarizes the buffered traces served by one route variant.
+type VariantStats struct {
+	Route     string  `json:"route"`
+	Variant   string  `json:"variant"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	AvgMs     int64   `json:"avgMs"`
+	P95Ms     int64   `json:"p95Ms"`
+}
+
+// variantStats groups traces by route and variant. A trace counts as an error
+// when the call failed or the response status is 5xx.
+func variantStats(entries []trace.Entry) []VariantStats {
+	type key struct{ route, variant string }
+	durations := make(map[key][]int64)
+	errs := make(map[key]int)
+	for _, e := range entries {
+		if e.Variant == "" {
+			continue
+		}
+		k := key{e.Route, e.Variant}
+		durations[k] = append(durations[k], e.DurationMs)
+		if e.Error != "" || e.StatusCode >= 500 {
+			errs[k]++
+		}
+	}
+
+	out := make([]VariantStats, 0, len(durations))
+	for k, ds := range durations {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		var sum int64
+		for _, d := range ds {
+			sum += d
+		}
+		out = append(out, VariantStats{
+			Route:     k.route,
+			Variant:   k.variant,
+			Requests:  len(ds),
+			Errors:    errs[k],
+			ErrorRate: float64(errs[k]) / float64(len(ds)),
+			AvgMs:     sum / int64(len(ds)),
+			P95Ms:     ds[(len(ds)*95-1)/100],
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Route != out[j].Route {
+			return out[i].Route < out[j].Route
+		}
+		return out[i].Variant < out[j].Variant
+	})
+	return out
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"soap-proxy/internal/config"
+)
+
+var (
+	errResponseHeaderTimeout = errors.New("timeout awaiting upstream response headers")
+	errTLSHandshakeTimeout   = errors.New("timeout during TLS handshake with upstream")
+)
+
+type timeoutsKey struct{}
+
+// timeouts is the budget applied to one request.
+type timeouts struct {
+	connect        time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+	total          time.Duration
+
+	// clientDeadline is set when the client's deadline is earlier than total.
+	clientDeadline bool
+}
+
+func timeoutsFromContext(ctx context.Context) (timeouts, bool) {
+	t, ok := ctx.Value(timeoutsKey{}).(timeouts)
+	return t, ok
+}
+
+// TimeoutPolicy resolves per-request timeouts from config and the client's deadline header.
+type TimeoutPolicy struct {
+	defaults       timeouts
+	actions        map[string]timeouts
+	deadlineHeader string
+}
+
+// newTimeoutPolicy builds a TimeoutPolicy from config.
+func newTimeoutPolicy(cfg config.TimeoutConfig) *TimeoutPolicy {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	p := &TimeoutPolicy{
+		defaults: timeouts{
+			connect:        ms(cfg.ConnectMs),
+			tlsHandshake:   ms(cfg.TLSHandshakeMs),
+			responseHeader: ms(cfg.ResponseHeaderMs),
+			total:          ms(cfg.TotalMs),
+		},
+		actions:        make(map[string]timeouts, len(cfg.Actions)),
+		deadlineHeader: cfg.DeadlineHeader,
+	}
+	for _, a := range cfg.Actions {
+		p.actions[a.SOAPAction] = timeouts{
+			connect:        ms(a.ConnectMs),
+			tlsHandshake:   ms(a.TLSHandshakeMs),
+			responseHeader: ms(a.ResponseHeaderMs),
+			total:          ms(a.TotalMs),
+		}
+	}
+	return p
+}
+
+// longestTLSHandshake returns the longest TLS handshake timeout configured.
+// It is the transports' own handshake timeout; shorter per-action ones are
+// enforced on each request by a handshakeTimer.
+func longestTLSHandshake(cfg config.TimeoutConfig) time.Duration {
+	ms := cfg.TLSHandshakeMs
+	for _, a := range cfg.Actions {
+		ms = max(ms, a.TLSHandshakeMs)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// apply bounds req by the SOAPAction's total timeout and the client's deadline,
+// whichever is earlier, and returns the budget in force.
+func (p *TimeoutPolicy) apply(req *http.Request, action string) (*http.Request, context.CancelFunc, time.Duration) {
+	if p == nil {
+		return req, func() {}, 0
+	}
+	t, ok := p.actions[action]
+	if !ok {
+		t = p.defaults
+	}
+
+	now := time.Now()
+	deadline := now.Add(t.total)
+	if d, ok := p.clientDeadline(req.Header.Get(p.deadlineHeader), now); ok && d.Before(deadline) {
+		deadline = d
+		t.clientDeadline = true
+	}
+
+	ctx := context.WithValue(req.Context(), timeoutsKey{}, t)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	return req.WithContext(ctx), cancel, deadline.Sub(now)
+}
+
+// clientDeadline parses a deadline header given either as milliseconds
+// remaining or as an RFC 3339 timestamp.
+func (p *TimeoutPolicy) clientDeadline(v string, now time.Time) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// Beyond the largest time.Duration, any deadline is later than the
+		// proxy's own budget anyway.
+		ms = min(max(ms, 0), math.MaxInt64/int64(time.Millisecond))
+		return now.Add(time.Duration(ms) * time.Millisecond), true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// callerAbandoned reports whether a call failed with err because of its
+// client: the client went away, or the deadline it sent expired before the
+// proxy's own budget would have.
+func callerAbandoned(ctx context.Context, err error) bool {
+	if classifyError(err) == errKindCanceled {
+		return true
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		return true
+	case context.DeadlineExceeded:
+		t, ok := timeoutsFromContext(ctx)
+		return ok && t.clientDeadline
+	}
+	return false
+}
+
+// propagate tells the upstream how much of the client's deadline is left, in
+// milliseconds. Requests without a deadline header are left without one, so
+// the proxy's own budget is not passed off as the client's.
+func (p *TimeoutPolicy) propagate(out *http.Request) {
+	if p == nil || out.Header.Get(p.deadlineHeader) == "" {
+		return
+	}
+	if deadline, ok := out.Context().Deadline(); ok {
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		out.Header.Set(p.deadlineHeader, strconv.FormatInt(remaining, 10))
+	}
+}
+
+// headerTimer cancels an upstream request whose response headers take longer
+// than the request's response-header timeout.
+type headerTimer struct {
+	timer  *time.Timer
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// startHeaderTimer arms a headerTimer for out, if it has a response-header timeout.
+func startHeaderTimer(out *http.Request) (*http.Request, *headerTimer) {
+	t, ok := timeoutsFromContext(out.Context())
+	if !ok || t.responseHeader <= 0 {
+		return out, nil
+	}
+	ctx, cancel := context.WithCancelCause(out.Context())
+	h := &headerTimer{ctx: ctx, cancel: cancel}
+	h.timer = time.AfterFunc(t.responseHeader, func() { cancel(errResponseHeaderTimeout) })
+	return out.WithContext(ctx), h
+}
+
+// stop disarms the timer once response headers have arrived.
+func (h *headerTimer) stop() {
+	if h != nil {
+		h.timer.Stop()
+	}
+}
+
+// done releases the request context once the response has been consumed,
+// reporting errResponseHeaderTimeout when the timer caused err.
+func (h *headerTimer) done(err error) error {
+	if h == nil {
+		return err
+	}
+	h.timer.Stop()
+	if err != nil && errors.Is(context.Cause(h.ctx), errResponseHeaderTimeout) {
+		err = errResponseHeaderTimeout
+	}
+	h.cancel(nil)
+	return err
+}
+
+// handshakeTimer cancels an upstream request whose TLS handshake takes longer
+// than the request's TLS handshake timeout. It is started and stopped by the
+// handshake's httptrace hooks, which run on the dialing goroutine.
+type handshakeTimer struct {
+	timeout time.Duration
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// startHandshakeTimer prepares a handshakeTimer for out, if it has a TLS
+// handshake timeout.
+func startHandshakeTimer(out *http.Request) (*http.Request, *handshakeTimer) {
+	t, ok := timeoutsFromContext(out.Context())
+	if !ok || t.tlsHandshake <= 0 {
+		return out, nil
+	}
+	ctx, cancel := context.WithCancelCause(out.Context())
+	return out.WithContext(ctx), &handshakeTimer{timeout: t.tlsHandshake, ctx: ctx, cancel: cancel}
+}
+
+// started arms the timer when a handshake begins.
+func (h *handshakeTimer) started() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer == nil {
+		h.timer = time.AfterFunc(h.timeout, func() { h.cancel(errTLSHandshakeTimeout) })
+	}
+}
+
+// finished disarms the timer once the handshake is over.
+func (h *handshakeTimer) finished() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// done releases the request context once the response has been consumed,
+// reporting errTLSHandshakeTimeout when the timer caused err.
+func (h *handshakeTimer) done(err error) error {
+	if h == nil {
+		return err
+	}
+	h.finished()
+	if err != nil && errors.Is(context.Cause(h.ctx), errTLSHandshakeTimeout) {
+		err = errTLSHandshakeTimeout
+	}
+	h.cancel(nil)
+	return err
+}
@@ -2,13 +2,15 @@ package proxy
 
 import (
     "bytes"
+    "context"
     "crypto/tls"
     "crypto/x509"
     "encoding/xml"
     "io"
+    "net"
     "net/http"
-    "os"
     "strings"
+    "sync"
     "time"
 
     "github.com/google/uuid"
@@ -20,37 +22,128 @@ const maxBodySize = 1 << 20 // 1MB
 
 // LoggingTransport wraps a RoundTripper to capture requests and responses.
 type LoggingTransport struct {
-	Base  http.RoundTripper
-	Store *storage.FileTraceStore
-	Hooks []*ActionHook
+	Base        http.RoundTripper
+	Store       *storage.FileTraceStore
+	Hooks       []*ActionHook
+	Router      *Router
+	Retries     map[string]*RetryPolicy
+	Hedges      map[string]*HedgePolicy
+	Breakers    *BreakerSet
+	Timeouts    *TimeoutPolicy
+	Limits      *RateLimiter
+	Bulkheads   *Bulkheads
+	Mirror      *Mirror
+	Headers     *HeaderRules
+	Cache       *ResponseCache
+	Coalescer   *Coalescer
+	Maintenance *Maintenance
+	Identity    *CallerIdentity
+	Certs       *CertMonitor
+	ClientTLS   *ClientTLS
+}
+
+// TransportOptions tunes the upstream http.Transport.
+type TransportOptions struct {
+	ConnectTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	// Egress, when set, routes upstream connections through a CONNECT proxy.
+	Egress *EgressProxy
+	// ServerName, when set, is verified instead of the host of the URL.
+	ServerName string
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	KeepAlive           time.Duration
+	DisableKeepAlives   bool
+	ForceAttemptHTTP2   bool
 }
 
 // NewMTLSTransport creates an http.RoundTripper using mTLS to the upstream.
-func NewMTLSTransport(certFile, keyFile, caFile string) (http.RoundTripper, error) {
-    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-    if err != nil {
-        return nil, err
-    }
-    caBytes, err := os.ReadFile(caFile)
-    if err != nil {
-        return nil, err
-    }
-    pool := x509.NewCertPool()
-    if !pool.AppendCertsFromPEM(caBytes) {
-        return nil, err
-    }
+// New connections present the current client certificate of creds; when its
+// CA bundle changes, requests move to a new connection pool.
+func NewMTLSTransport(creds *ClientCredentials, opts TransportOptions) http.RoundTripper {
+	return &mtlsTransport{creds: creds, opts: opts}
+}
 
-    cfg := &tls.Config{
-        Certificates: []tls.Certificate{cert},
-        RootCAs:      pool,
-        MinVersion:   tls.VersionTLS12,
-    }
-    return &http.Transport{TLSClientConfig: cfg}, nil
+type mtlsTransport struct {
+	creds *ClientCredentials
+	opts  TransportOptions
+
+	mu    sync.Mutex
+	tr    *http.Transport
+	roots *x509.CertPool
+}
+
+func (t *mtlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport().RoundTrip(req)
+}
+
+// transport returns the http.Transport trusting the current CA pool. The
+// previous one closes its idle connections; requests in flight on it finish
+// normally.
+func (t *mtlsTransport) transport() *http.Transport {
+	roots := t.creds.rootCAs()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if roots == t.roots {
+		return t.tr
+	}
+	old := t.tr
+	t.tr, t.roots = t.newTransport(roots), roots
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+	return t.tr
+}
+
+func (t *mtlsTransport) newTransport(roots *x509.CertPool) *http.Transport {
+	opts := t.opts
+	cfg := &tls.Config{
+		GetClientCertificate: t.creds.clientCertificate,
+		RootCAs:              roots,
+		ServerName:           opts.ServerName,
+		MinVersion:           tls.VersionTLS12,
+	}
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: opts.KeepAlive}
+	tr := &http.Transport{
+		TLSClientConfig:     cfg,
+		DialContext:         dialContext(dialer, opts.Egress),
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+		ForceAttemptHTTP2:   opts.ForceAttemptHTTP2,
+	}
+	if opts.Egress != nil {
+		tr.Proxy = opts.Egress.Proxy
+		tr.OnProxyConnectResponse = opts.Egress.onConnectResponse
+	}
+	return tr
+}
+
+// dialContext dials with the request's connect timeout when it has one.
+// Failed dials to the egress proxy are reported as proxyConnectErrors.
+func dialContext(dialer *net.Dialer, egress *EgressProxy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := dialer
+		if t, ok := timeoutsFromContext(ctx); ok && t.connect > 0 {
+			d = &net.Dialer{Timeout: t.connect, KeepAlive: dialer.KeepAlive}
+		}
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil && egress.isProxyAddr(addr) {
+			return nil, &proxyConnectError{proxy: addr, err: err}
+		}
+		return conn, err
+	}
 }
 
 // NewLoggingTransport constructs a LoggingTransport.
-func NewLoggingTransport(base http.RoundTripper, store *storage.FileTraceStore, hooks []*ActionHook) *LoggingTransport {
-	return &LoggingTransport{Base: base, Store: store, Hooks: hooks}
+func NewLoggingTransport(base http.RoundTripper, store *storage.FileTraceStore, hooks []*ActionHook, router *Router) *LoggingTransport {
+	return &LoggingTransport{Base: base, Store: store, Hooks: hooks, Router: router}
 }
 
 // extractSOAPAction tries, in order:
@@ -104,54 +197,75 @@ func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
     if truncatedReq {
         reqBytes = reqBytes[:maxBodySize]
     }
-    req.Body = io.NopCloser(bytes.NewReader(reqBytes))
 
     soapAction := extractSOAPAction(req.Header, reqBytes)
 
+    route := t.Router.Match(req, soapAction)
+    primary, variant := route.selectUpstream(req)
+    clientPath := req.URL.Path
+    if p := route.rewrite.apply(clientPath); p != clientPath {
+        req.URL.Path = p
+        req.URL.RawPath = ""
+    }
+
+    caller := t.Identity.identify(req)
+
     entry := trace.Entry{
-        ID:         id,
-        StartedAt:  start,
-        ClientAddr: clientAddr,
-        Method:     req.Method,
-        Path:       req.URL.Path,
-        Host:       req.Host,
-        SOAPAction: soapAction,
+        ID:           id,
+        StartedAt:    start,
+        ClientAddr:   clientAddr,
+        Caller:       caller,
+        Method:       req.Method,
+        Path:         req.URL.Path,
+        OriginalPath: clientPath,
+        Host:         req.Host,
+        SOAPAction:   soapAction,
+        Route:        route.Name,
+        Variant:      variant,
         Req: trace.HTTPMessage{
-            Headers:   req.Header.Clone(),
+            Headers:   t.Identity.redact(req.Header.Clone()),
             Body:      string(reqBytes),
             Truncated: truncatedReq,
         },
         SizeReqBytes: len(reqBytes),
     }
+    // The trace keeps the headers as the client sent them, bar the API key.
+    t.Identity.apply(req.Header, caller)
 
-    resp, err := t.Base.RoundTrip(req)
+    res, err := t.handle(req, reqBytes, route.targets(primary), &entry)
     entry.DurationMs = time.Since(start).Milliseconds()
 
+    // Only requests that actually went upstream are mirrored.
+    var shadow *shadowCall
+    if len(entry.Attempts) > 0 {
+        shadow = t.startShadow(req, reqBytes, soapAction)
+    }
+
     if err != nil {
         entry.Error = err.Error()
-        _ = t.Store.Add(entry)
-        return nil, err
+        entry.ErrorKind = classifyError(err)
+        fault, ok := faultFor(err, entry.ErrorKind)
+        if !ok {
+            t.record(entry, shadow)
+            return nil, err
+        }
+        res = fault.result(req)
     }
 
-    var respBuf bytes.Buffer
-    if resp.Body != nil {
-        _, _ = io.Copy(&respBuf, io.LimitReader(resp.Body, maxBodySize+1))
-        _ = resp.Body.Close()
-    }
-    respBytes := respBuf.Bytes()
-    truncatedResp := len(respBytes) > maxBodySize
-    if truncatedResp {
-        respBytes = respBytes[:maxBodySize]
-    }
+    resp := res.resp
+    respBytes := res.body
     resp.Body = io.NopCloser(bytes.NewReader(respBytes))
 
     entry.StatusCode = resp.StatusCode
     entry.Resp = trace.HTTPMessage{
         Headers:   resp.Header.Clone(),
         Body:      string(respBytes),
-        Truncated: truncatedResp,
+        Truncated: res.truncated,
     }
     entry.SizeRespBytes = len(respBytes)
+    if t.Headers.applyResponse(resp.Header, newHeaderData(req, &entry, entry.Upstream)) {
+        entry.ClientRespHeaders = resp.Header.Clone()
+    }
 
 	for _, h := range t.Hooks {
 		if h != nil {
@@ -159,6 +273,6 @@ func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		}
 	}
 
-	_ = t.Store.Add(entry)
+	t.record(entry, shadow)
 	return resp, nil
 }
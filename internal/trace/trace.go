@@ -11,19 +11,94 @@ type HTTPMessage struct {
     Truncated bool        `json:"truncated"`
 }
 
+// Attempt is one try at sending a request upstream.
+type Attempt struct {
+    Try           int       `json:"try"`
+    Upstream      string    `json:"upstream"`
+    URL           string    `json:"url"`
+    StartedAt     time.Time `json:"startedAt"`
+    DurationMs    int64     `json:"durationMs"`
+    StatusCode    int       `json:"statusCode,omitempty"`
+    Error         string    `json:"error,omitempty"`
+    ErrorKind     string    `json:"errorKind,omitempty"`
+    // Circuit is the breaker state seen by the attempt; CircuitChange is the
+    // transition ("closed->open") its outcome caused, if any.
+    Circuit       string    `json:"circuit,omitempty"`
+    CircuitChange string    `json:"circuitChange,omitempty"`
+    // Hedge marks the second copy of a hedged request; Winner marks the
+    // attempt whose response was used.
+    Hedge         bool      `json:"hedge,omitempty"`
+    Winner        bool      `json:"winner,omitempty"`
+    // ConnReused reports whether the attempt used a pooled connection; Proto
+    // is the protocol of the response, e.g. HTTP/1.1 or HTTP/2.0.
+    ConnReused    bool      `json:"connReused"`
+    Proto         string    `json:"proto,omitempty"`
+    // ClientCert is the subject of the client certificate presented to the
+    // upstream.
+    ClientCert    string    `json:"clientCert,omitempty"`
+}
+
+// Shadow is the response of a mirrored copy of the request, compared with the
+// primary response after XML canonicalization.
+type Shadow struct {
+    Upstream   string      `json:"upstream"`
+    URL        string      `json:"url,omitempty"`
+    DurationMs int64       `json:"durationMs"`
+    StatusCode int         `json:"statusCode,omitempty"`
+    Resp       HTTPMessage `json:"resp"`
+    Error      string      `json:"error,omitempty"`
+    ErrorKind  string      `json:"errorKind,omitempty"`
+    Differs    bool        `json:"differs"`
+    Difference string      `json:"difference,omitempty"`
+}
+
+// Caller identifies who sent a request: the client's verified certificate
+// when the proxy listener uses mTLS, and the name of a known API key.
+type Caller struct {
+    Subject     string   `json:"subject,omitempty"`
+    SANs        []string `json:"sans,omitempty"`
+    Fingerprint string   `json:"fingerprint,omitempty"` // SHA-256 of the certificate
+    APIKey      string   `json:"apiKey,omitempty"`
+}
+
 type Entry struct {
-    ID            string      `json:"id"`
-    StartedAt     time.Time   `json:"startedAt"`
-    DurationMs    int64       `json:"durationMs"`
-    ClientAddr    string      `json:"clientAddr"`
-    Method        string      `json:"method"`
-    Path          string      `json:"path"`
-    Host          string      `json:"host"`
-    StatusCode    int         `json:"statusCode"`
-    SOAPAction    string      `json:"soapAction"`
-    Req           HTTPMessage `json:"req"`
-    Resp          HTTPMessage `json:"resp"`
-    Error         string      `json:"error,omitempty"`
-    SizeReqBytes  int         `json:"sizeReqBytes"`
-    SizeRespBytes int         `json:"sizeRespBytes"`
+    ID                 string      `json:"id"`
+    StartedAt          time.Time   `json:"startedAt"`
+    DurationMs         int64       `json:"durationMs"`
+    ClientAddr         string      `json:"clientAddr"`
+    Caller             *Caller     `json:"caller,omitempty"`
+    Method             string      `json:"method"`
+    // Path is the path sent upstream; OriginalPath is the client's path.
+    Path               string      `json:"path"`
+    OriginalPath       string      `json:"originalPath,omitempty"`
+    Host               string      `json:"host"`
+    StatusCode         int         `json:"statusCode"`
+    SOAPAction         string      `json:"soapAction"`
+    Route              string      `json:"route,omitempty"`
+    Variant            string      `json:"variant,omitempty"`
+    Upstream           string      `json:"upstream,omitempty"`
+    UpstreamURL        string      `json:"upstreamUrl,omitempty"`
+    Req                HTTPMessage `json:"req"`
+    Resp               HTTPMessage `json:"resp"`
+    // UpstreamReqHeaders are the request headers sent upstream on the last
+    // attempt; ClientRespHeaders are the response headers returned to the
+    // client when header rules rewrote them.
+    UpstreamReqHeaders http.Header `json:"upstreamReqHeaders,omitempty"`
+    ClientRespHeaders  http.Header `json:"clientRespHeaders,omitempty"`
+    Error              string      `json:"error,omitempty"`
+    ErrorKind          string      `json:"errorKind,omitempty"`
+    Attempts           []Attempt   `json:"attempts,omitempty"`
+    Hedged             bool        `json:"hedged,omitempty"`
+    // Cache is "hit" when the response came from the cache, "stored" when it
+    // was added to it, and "miss" when a cacheable response was not stored.
+    Cache              string      `json:"cache,omitempty"`
+    // CoalescedWith is the ID of the trace whose upstream call answered this
+    // request; CoalescedRequests counts the requests that shared this one's.
+    CoalescedWith      string      `json:"coalescedWith,omitempty"`
+    CoalescedRequests  int         `json:"coalescedRequests,omitempty"`
+    TimeoutMs          int64       `json:"timeoutMs,omitempty"`
+    QueueWaitMs        int64       `json:"queueWaitMs,omitempty"`
+    Shadow             *Shadow     `json:"shadow,omitempty"`
+    SizeReqBytes       int         `json:"sizeReqBytes"`
+    SizeRespBytes      int         `json:"sizeRespBytes"`
 }
@@ -36,14 +36,20 @@ const htmlPage = `<!doctype html>
     .fail-badge { display: inline-block; padding: 2px 6px; border-radius: 4px; background: #f44; color: #fff; font-size: 11px; margin-left: 6px; }
     .tracking-badge { display: inline-block; padding: 2px 6px; border-radius: 4px; background: #eef; color: #224; font-size: 11px; margin-left: 6px; }
     ul.related-list { padding-left: 18px; font-size: 12px; }
+    #upstreams { padding: 6px; border-bottom: 1px solid #ddd; font-size: 12px; flex-shrink: 0; }
+    .member { display: inline-block; padding: 1px 5px; border-radius: 4px; margin: 1px 4px 1px 0; }
+    .member-up { background: #e6f7ea; color: #175; }
+    .member-down { background: #ffe6e6; color: #a22; }
   </style>
 </head>
 <body>
   <div id="list">
+    <div id="upstreams"></div>
     <div id="filters">
       <input type="text" id="filterPath" placeholder="Filter path...">
       <input type="text" id="filterAction" placeholder="Filter SOAPAction...">
       <input type="text" id="filterTracking" placeholder="Filter TrackingId...">
+      <input type="text" id="filterCaller" placeholder="Filter caller...">
     </div>
     <div id="tableWrapper">
       <table id="traceTable">
@@ -52,6 +58,7 @@ const htmlPage = `<!doctype html>
             <th>Time</th>
             <th>SOAPAction</th>
             <th>TrackingId</th>
+            <th>Upstream</th>
             <th>Status</th>
             <th>Dur (ms)</th>
           </tr>
@@ -147,11 +154,75 @@ async function loadTraces() {
   renderTraceTable();
 }
 
+async function loadUpstreams() {
+  const res = await fetch('/api/upstreams');
+  if (!res.ok) return;
+  const upstreams = await res.json();
+  let html = '';
+  upstreams.forEach(function(u) {
+    html += '<div><strong>' + escapeHtml(u.name) + '</strong> (' + escapeHtml(u.balancer) + '): ';
+    (u.members || []).forEach(function(m) {
+      const title = m.lastError ? ' title="' + escapeHtml(m.lastError) + '"' : '';
+      html += '<span class="member ' + (m.healthy ? 'member-up' : 'member-down') + '"' + title + '>' +
+        escapeHtml(m.url) + ' [' + m.outstanding + ']</span>';
+    });
+    if (u.discovery) {
+      const d = u.discovery;
+      html += ' <small>' + escapeHtml(d.type) + ': ' + escapeHtml(d.source) +
+        ', changed ' + escapeHtml(new Date(d.lastChange).toLocaleString()) +
+        (d.lastError ? ' <span class="fail-badge">' + escapeHtml(d.lastError) + '</span>' : '') + '</small>';
+    }
+    html += '</div>';
+  });
+  const vres = await fetch('/api/variants');
+  if (vres.ok) {
+    const variants = await vres.json();
+    if (variants.length > 0) {
+      html += '<table><thead><tr><th>Route</th><th>Variant</th><th>Requests</th><th>Errors</th><th>Avg (ms)</th><th>p95 (ms)</th></tr></thead><tbody>';
+      variants.forEach(function(v) {
+        html += '<tr><td>' + escapeHtml(v.route) + '</td><td>' + escapeHtml(v.variant) + '</td>' +
+          '<td>' + v.requests + '</td>' +
+          '<td>' + v.errors + ' (' + (v.errorRate * 100).toFixed(1) + '%)</td>' +
+          '<td>' + v.avgMs + '</td><td>' + v.p95Ms + '</td></tr>';
+      });
+      html += '</tbody></table>';
+    }
+  }
+  const mres = await fetch('/api/maintenance');
+  if (mres.ok) {
+    const m = await mres.json();
+    if (m.active) {
+      html = '<div><span class="fail-badge">Maintenance mode active</span> ' +
+        escapeHtml(m.enabled ? (m.soapActions && m.soapActions.length ? m.soapActions.join(', ') : 'all SOAPActions') : 'scheduled window') +
+        '</div>' + html;
+    }
+  }
+  const cres = await fetch('/api/certs/expiry');
+  if (cres.ok) {
+    const c = await cres.json();
+    c.certificates.filter(function(x) { return x.warning; }).forEach(function(x) {
+      const where = x.kind === 'upstream' ? x.upstream + ' ' + x.host : x.kind;
+      const when = x.daysLeft < 0 ? 'expired ' + Math.floor(-x.daysLeft) + ' day(s) ago' :
+        'expires in ' + Math.floor(x.daysLeft) + ' day(s)';
+      html = '<div><span class="fail-badge">Certificate ' + escapeHtml(when) + '</span> ' +
+        escapeHtml(x.subject) + ' <small>(' + escapeHtml(where) + ', ' +
+        escapeHtml(new Date(x.notAfter).toLocaleString()) + ')</small></div>' + html;
+    });
+  }
+  document.getElementById('upstreams').innerHTML = html;
+}
+
+function callerText(c) {
+  if (!c) return '';
+  return [c.subject, c.fingerprint, c.apiKey].concat(c.sans || []).join(' ').toLowerCase();
+}
+
 function renderTraceTable() {
   const tbody = document.querySelector('#traceTable tbody');
   const pathFilter = document.getElementById('filterPath').value.toLowerCase();
   const actionFilter = document.getElementById('filterAction').value.toLowerCase();
   const trackingFilter = document.getElementById('filterTracking').value.toLowerCase();
+  const callerFilter = document.getElementById('filterCaller').value.toLowerCase();
 
   tbody.innerHTML = '';
   const filtered = allTraces.filter(function(t) {
@@ -160,7 +231,8 @@ function renderTraceTable() {
     const trackingId = getHeaderValue(t.req && t.req.headers, 'Trackingid').toLowerCase();
     return (!pathFilter || p.includes(pathFilter)) &&
            (!actionFilter || soapActionVal.includes(actionFilter)) &&
-           (!trackingFilter || trackingId.includes(trackingFilter));
+           (!trackingFilter || trackingId.includes(trackingFilter)) &&
+           (!callerFilter || callerText(t.caller).includes(callerFilter));
   });
 
   filtered.slice().reverse().forEach(function(t) {
@@ -185,7 +257,11 @@ function renderTraceTable() {
       '<td>' + d.toLocaleTimeString() + '</td>' +
       '<td>' + escapeHtml(soapActionVal) + '</td>' +
       '<td>' + escapeHtml(trackingIdVal || '') + '</td>' +
-      '<td class="' + statusClass + '">' + (t.statusCode || '') + '</td>' +
+      '<td>' + escapeHtml(t.upstream || '') + '</td>' +
+      '<td class="' + statusClass + '">' + (t.statusCode || '') +
+        (t.errorKind ? ' <span class="fail-badge">' + escapeHtml(t.errorKind) + '</span>' : '') +
+        (t.shadow && t.shadow.differs ? ' <span class="fail-badge">shadow differs</span>' : '') +
+        (t.cache === 'hit' ? ' <span class="tracking-badge">cached</span>' : '') + '</td>' +
       '<td>' + (t.durationMs || '') + '</td>';
 
     tr.onclick = function() { loadDetail(t.id); };
@@ -193,6 +269,46 @@ function renderTraceTable() {
   });
 }
 
+function renderAttempts(t) {
+  if (!t.attempts || t.attempts.length === 0) return '';
+  let html = '<h4>Upstream attempts' + (t.hedged ? ' (hedged)' : '') + '</h4><table><thead><tr><th>#</th><th>Try</th><th>Upstream</th><th>URL</th><th>Status</th><th>Dur (ms)</th><th>Conn</th><th>Client cert</th><th>Circuit</th><th>Error</th></tr></thead><tbody>';
+  t.attempts.forEach(function(a, i) {
+    const err = a.error ? '[' + (a.errorKind || 'error') + '] ' + a.error : '';
+    html += '<tr' + (a.error ? ' class="fail-row"' : '') + '>' +
+      '<td>' + (i + 1) + '</td>' +
+      '<td>' + (a.try || 1) + (a.hedge ? ' (hedge)' : '') + (a.winner ? ' &#10003;' : '') + '</td>' +
+      '<td>' + escapeHtml(a.upstream) + '</td>' +
+      '<td>' + escapeHtml(a.url) + '</td>' +
+      '<td>' + (a.statusCode || '') + '</td>' +
+      '<td>' + (a.durationMs || 0) + '</td>' +
+      '<td>' + escapeHtml(a.proto || '') + (a.connReused ? ' reused' : '') + '</td>' +
+      '<td>' + escapeHtml(a.clientCert || '') + '</td>' +
+      '<td>' + escapeHtml(a.circuitChange || a.circuit || '') + '</td>' +
+      '<td>' + escapeHtml(err) + '</td>' +
+      '</tr>';
+  });
+  return html + '</tbody></table>';
+}
+
+function renderShadow(t) {
+  const s = t.shadow;
+  if (!s) return '';
+  let html = '<h4>Shadow response (' + escapeHtml(s.upstream) + ')</h4>';
+  html += '<p><strong>Status:</strong> ' + (s.statusCode || '') +
+    ' &middot; <strong>Duration:</strong> ' + (s.durationMs || 0) + ' ms</p>';
+  if (s.error) {
+    html += '<p><span class="fail-badge">' + escapeHtml(s.errorKind || 'error') + '</span> ' + escapeHtml(s.error) + '</p>';
+  }
+  if (s.differs) {
+    html += '<p><span class="fail-badge">Differs from primary</span> ' + escapeHtml(s.difference || '') + '</p>';
+  } else {
+    html += '<p><span class="tracking-badge">Matches primary</span></p>';
+  }
+  const body = s.resp && s.resp.body || '';
+  html += '<pre>' + escapeHtml(isXmlContent(s.resp && s.resp.headers) ? formatXml(body) : body) + '</pre>';
+  return html;
+}
+
 async function loadDetail(id) {
   const res = await fetch('/api/traces/' + id);
   if (!res.ok) return;
@@ -242,13 +358,43 @@ async function loadDetail(id) {
 
   const reqHeadersJson = JSON.stringify(t.req && t.req.headers || {}, null, 2);
   const respHeadersJson = JSON.stringify(t.resp && t.resp.headers || {}, null, 2);
+  const upstreamHeadersHtml = t.upstreamReqHeaders
+    ? '<h4>Request headers sent upstream</h4><pre>' + escapeHtml(JSON.stringify(t.upstreamReqHeaders, null, 2)) + '</pre>'
+    : '';
+  const clientHeadersHtml = t.clientRespHeaders
+    ? '<h4>Response headers sent to client</h4><pre>' + escapeHtml(JSON.stringify(t.clientRespHeaders, null, 2)) + '</pre>'
+    : '';
 
   let topLine = '<h3>' + escapeHtml(t.method || '') + ' ' + escapeHtml(t.path || '') + '</h3>';
+  if (t.originalPath && t.originalPath !== t.path) {
+    topLine += '<p><strong>Client path:</strong> ' + escapeHtml(t.originalPath) + ' &rarr; ' + escapeHtml(t.path || '') + '</p>';
+  }
   topLine += '<p><strong>SOAPAction:</strong> ' + soapActionHtml + '</p>';
   topLine += '<p><strong>TrackingId:</strong> ' + trackingHtml + '</p>';
+  topLine += '<p><strong>Route:</strong> ' + escapeHtml(t.route || '') +
+    (t.variant ? ' [' + escapeHtml(t.variant) + ']' : '') + ' &rarr; ' + escapeHtml(t.upstream || '') +
+    (t.upstreamUrl ? ' (' + escapeHtml(t.upstreamUrl) + ')' : '') + '</p>';
   topLine += '<p><strong>Status:</strong> ' + (t.statusCode || '') + '</p>';
-  topLine += '<p><strong>Duration:</strong> ' + (t.durationMs || '') + ' ms</p>';
+  topLine += '<p><strong>Duration:</strong> ' + (t.durationMs || '') + ' ms' +
+    (t.queueWaitMs ? ' (queued ' + t.queueWaitMs + ' ms)' : '') + '</p>';
+  if (t.cache) {
+    topLine += '<p><strong>Cache:</strong> ' + escapeHtml(t.cache) + '</p>';
+  }
+  if (t.coalescedWith) {
+    topLine += '<p><strong>Coalesced:</strong> answered by the upstream call of <a href="#" onclick="loadDetail(\'' +
+      escapeHtml(t.coalescedWith) + '\'); return false;">' + escapeHtml(t.coalescedWith) + '</a></p>';
+  } else if (t.coalescedRequests) {
+    topLine += '<p><strong>Coalesced:</strong> upstream call shared with ' + t.coalescedRequests + ' other request(s)</p>';
+  }
   topLine += '<p><strong>Client:</strong> ' + escapeHtml(t.clientAddr || '') + '</p>';
+  if (t.caller) {
+    const who = [];
+    if (t.caller.subject) who.push(escapeHtml(t.caller.subject));
+    if (t.caller.sans) who.push('SANs: ' + escapeHtml(t.caller.sans.join(', ')));
+    if (t.caller.fingerprint) who.push('SHA-256: <code>' + escapeHtml(t.caller.fingerprint) + '</code>');
+    if (t.caller.apiKey) who.push('API key: ' + escapeHtml(t.caller.apiKey));
+    topLine += '<p><strong>Caller:</strong> ' + who.join(' &middot; ') + '</p>';
+  }
 
   if (failInBody) {
     topLine += '<p><span class="fail-badge">Failure detected (body contains "Fail")</span></p>';
@@ -256,25 +402,36 @@ async function loadDetail(id) {
     topLine += '<p><span class="tracking-badge">TrackingId present</span></p>';
   }
 
+  if (t.error) {
+    topLine += '<p><span class="fail-badge">' + escapeHtml(t.errorKind || 'error') + '</span> ' + escapeHtml(t.error) + '</p>';
+  }
+
   el.innerHTML =
     topLine +
+    renderAttempts(t) +
     '<h4>Request headers</h4>' +
     '<pre>' + escapeHtml(reqHeadersJson) + '</pre>' +
+    upstreamHeadersHtml +
     '<h4>Request body</h4>' +
     '<pre>' + escapeHtml(reqBody) + '</pre>' +
     '<h4>Response headers</h4>' +
     '<pre>' + escapeHtml(respHeadersJson) + '</pre>' +
+    clientHeadersHtml +
     '<h4>Response body</h4>' +
     '<pre>' + escapeHtml(respBody) + '</pre>' +
+    renderShadow(t) +
     relatedHtml;
 }
 
 document.getElementById('filterPath').addEventListener('input', renderTraceTable);
 document.getElementById('filterAction').addEventListener('input', renderTraceTable);
 document.getElementById('filterTracking').addEventListener('input', renderTraceTable);
+document.getElementById('filterCaller').addEventListener('input', renderTraceTable);
 
 loadTraces();
+loadUpstreams();
 setInterval(loadTraces, 2000);
+setInterval(loadUpstreams, 5000);
 </script>
 </body>
 </html>`